@@ -0,0 +1,134 @@
+package dcache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultCoalesce is the wait of coalesce without an argument.
+	defaultCoalesce = 200 * time.Millisecond
+	// announceQueue is the number of announcements waiting to be published.
+	// Announcements beyond it are dropped, as a late one is worthless.
+	announceQueue = 1024
+	// announceMaxAge is the age in seconds beyond which a received
+	// announcement, such as one replayed from a stream, is ignored.
+	announceMaxAge = 2
+)
+
+// flights tracks the questions being resolved, by this node or by a peer that
+// announced it, so that a miss for one of them waits for its answer instead
+// of resolving it again.
+type flights struct {
+	mu sync.Mutex
+	m  map[uint64]chan struct{}
+}
+
+func newFlights() *flights {
+	return &flights{m: make(map[uint64]chan struct{})}
+}
+
+// begin starts a flight for key unless one is in progress. It returns the
+// channel closed when the flight ends, and whether the caller leads it.
+func (f *flights) begin(key uint64) (chan struct{}, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if done, ok := f.m[key]; ok {
+		return done, false
+	}
+	done := make(chan struct{})
+	f.m[key] = done
+	return done, true
+}
+
+// announce starts a flight for key led by a peer, which ends after wait
+// unless the answer arrives first.
+func (f *flights) announce(key uint64, wait time.Duration) {
+	done, leader := f.begin(key)
+	if leader {
+		time.AfterFunc(wait, func() { f.end(key, done) })
+	}
+}
+
+// end ends the flight for key. A nil done ends any flight for key, otherwise
+// only the flight done belongs to.
+func (f *flights) end(key uint64, done chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cur, ok := f.m[key]
+	if !ok || (done != nil && cur != done) {
+		return
+	}
+	delete(f.m, key)
+	close(cur)
+}
+
+// await waits for the flight done, and answers r from the cache when it
+// brought an answer.
+func (d *Dcache) await(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state *request.Request, done chan struct{}) bool {
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return false
+	}
+
+	if !d.fromCache(ctx, w, r, state, time.Now().UTC().Unix()) {
+		return false
+	}
+	coalesced.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	return true
+}
+
+// announce queues an announcement that this node is resolving the question
+// of state. The time to die of an announcement is the second before it was
+// made: peers that predate announcements store it expired and never serve it.
+func (d *Dcache) announce(state *request.Request) {
+	m := new(dns.Msg)
+	m.Question = []dns.Question{state.Req.Question[0]}
+	ans := &AnswerCache{
+		Name:      state.Name(),
+		Type:      dns.Type(state.QType()),
+		Class:     dns.Class(state.QClass()),
+		Do:        state.Do(),
+		Cd:        state.Req.CheckingDisabled,
+		Response:  m,
+		TimeToDie: time.Now().UTC().Unix() - 1,
+		By:        d.id,
+		Resolving: true,
+	}
+
+	select {
+	case d.announcements <- ans:
+	default:
+	}
+}
+
+// runAnnounce publishes queued announcements until ctx is done. Announcements
+// skip the publish queue and the snapshot, as only live peers care about them.
+func (d *Dcache) runAnnounce(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ans := <-d.announcements:
+			if err := d.Transport.Publish(ctx, ans); err != nil {
+				d.log.Debugf("failed announce %s %s", ans.Name, err)
+			}
+		}
+	}
+}
+
+// announced records the announcement ans of a peer.
+func (d *Dcache) announced(ans *AnswerCache) {
+	if d.Coalesce <= 0 || time.Now().UTC().Unix()-ans.TimeToDie > announceMaxAge {
+		return
+	}
+	d.flights.announce(ans.key(), d.Coalesce)
+}
@@ -0,0 +1,207 @@
+package dcache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// countingNext answers every query after release is closed, and counts them in n.
+func countingNext(n *int32, release chan struct{}) plugin.Handler {
+	return plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		atomic.AddInt32(n, 1)
+		<-release
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{test.A("bootjp.me.	300	IN	A	192.0.2.1")}
+		_ = w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+}
+
+func serveAsync(c *Dcache, id uint16) chan *dns.Msg {
+	ch := make(chan *dns.Msg, 1)
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion("bootjp.me.", dns.TypeA)
+		req.Id = id
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, _ = c.ServeDNS(context.TODO(), rec, req)
+		ch <- rec.Msg
+	}()
+	return ch
+}
+
+func TestCoalesceLocal(t *testing.T) {
+	var resolved int32
+	release := make(chan struct{})
+	c, _ := newTestCache()
+	c.Coalesce = defaultCoalesce
+	c.Next = countingNext(&resolved, release)
+
+	var replies []chan *dns.Msg
+	for i := 0; i < 16; i++ {
+		replies = append(replies, serveAsync(c, uint16(i)))
+	}
+	for atomic.LoadInt32(&resolved) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i, ch := range replies {
+		m := <-ch
+		if m == nil || m.Id != uint16(i) || len(m.Answer) == 0 {
+			t.Errorf("Query %d: expected an answer with id %d, got %v", i, i, m)
+		}
+	}
+	if n := atomic.LoadInt32(&resolved); n != 1 {
+		t.Errorf("Expected 1 resolution, got %d", n)
+	}
+}
+
+func TestCoalescePeer(t *testing.T) {
+	bus := NewMemoryBus()
+	a, _ := newTestCache()
+	a.Transport = NewMemoryTransport(bus)
+	b, _ := newTestCache()
+	b.Transport = NewMemoryTransport(bus)
+	defer a.Transport.Close()
+	defer b.Transport.Close()
+
+	var aResolved, bResolved int32
+	release := make(chan struct{})
+	a.Coalesce = time.Minute
+	a.Next = countingNext(&aResolved, release)
+	b.Coalesce = time.Minute
+	b.Next = countingNext(&bResolved, make(chan struct{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	sub := b.Transport.Subscribe(ctx)
+	runSubscribe := func(ctx context.Context) { b.runSubscribe(ctx, sub) }
+	for _, f := range []func(context.Context){a.runPublish, a.runAnnounce, runSubscribe} {
+		wg.Add(1)
+		go func(f func(context.Context)) {
+			defer wg.Done()
+			f(ctx)
+		}(f)
+	}
+
+	ra := serveAsync(a, 1)
+	key := hash("bootjp.me.", dns.TypeA, dns.ClassINET, false, false)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.flights.mu.Lock()
+		_, ok := b.flights.m[key]
+		b.flights.mu.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the announcement of the resolution on the peer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// b waits for the answer of a instead of resolving it.
+	rb := serveAsync(b, 2)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if m := <-ra; m == nil || len(m.Answer) == 0 {
+		t.Errorf("Expected an answer from the resolving node, got %v", m)
+	}
+	if m := <-rb; m == nil || m.Id != 2 || len(m.Answer) == 0 {
+		t.Errorf("Expected the published answer on the peer, got %v", m)
+	}
+	if n := atomic.LoadInt32(&bResolved); n != 0 {
+		t.Errorf("Expected no resolution on the peer, got %d", n)
+	}
+}
+
+func TestCoalesceWait(t *testing.T) {
+	var resolved int32
+	release := make(chan struct{})
+	close(release)
+	c, _ := newTestCache()
+	c.Coalesce = 50 * time.Millisecond
+	c.Next = countingNext(&resolved, release)
+
+	// A peer announces a resolution and never publishes the answer.
+	m := new(dns.Msg)
+	m.SetQuestion("bootjp.me.", dns.TypeA)
+	c.announced(&AnswerCache{
+		Name:      "bootjp.me.",
+		Type:      dns.Type(dns.TypeA),
+		Response:  m,
+		TimeToDie: time.Now().Unix() - 1,
+		Resolving: true,
+	})
+
+	start := time.Now()
+	if m := <-serveAsync(c, 1); m == nil || len(m.Answer) == 0 {
+		t.Fatalf("Expected an answer after the wait, got %v", m)
+	}
+	if d := time.Since(start); d < c.Coalesce {
+		t.Errorf("Expected to wait %s for the peer, answered after %s", c.Coalesce, d)
+	}
+	if n := atomic.LoadInt32(&resolved); n != 1 {
+		t.Errorf("Expected 1 resolution after the wait, got %d", n)
+	}
+
+	// Announcements replayed long after they were made are ignored.
+	c.announced(&AnswerCache{Name: "example.org.", Type: dns.Type(dns.TypeA), Response: m, TimeToDie: time.Now().Unix() - 60, Resolving: true})
+	if n := len(c.flights.m); n != 0 {
+		t.Errorf("Expected an old announcement ignored, got %d flights", n)
+	}
+}
+
+func TestCoalesceAfterWait(t *testing.T) {
+	var resolved int32
+	release := make(chan struct{})
+	c, _ := newTestCache()
+	c.Coalesce = 50 * time.Millisecond
+	c.Next = countingNext(&resolved, release)
+
+	// A peer announces a resolution and never publishes the answer.
+	m := new(dns.Msg)
+	m.SetQuestion("bootjp.me.", dns.TypeA)
+	c.announced(&AnswerCache{
+		Name:      "bootjp.me.",
+		Type:      dns.Type(dns.TypeA),
+		Response:  m,
+		TimeToDie: time.Now().Unix() - 1,
+		Resolving: true,
+	})
+
+	var replies []chan *dns.Msg
+	for i := 0; i < 16; i++ {
+		replies = append(replies, serveAsync(c, uint16(i)))
+	}
+	// The first miss after the wait resolves, and the others wait for it.
+	for atomic.LoadInt32(&resolved) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for i, ch := range replies {
+		if m := <-ch; m == nil || m.Id != uint16(i) || len(m.Answer) == 0 {
+			t.Errorf("Query %d: expected an answer with id %d, got %v", i, i, m)
+		}
+	}
+	if n := atomic.LoadInt32(&resolved); n != 1 {
+		t.Errorf("Expected 1 resolution after the wait, got %d", n)
+	}
+}
@@ -0,0 +1,247 @@
+package dcache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/goccy/go-json"
+	"github.com/miekg/dns"
+)
+
+// Encodings of a published AnswerCache.
+const (
+	encodingJSON   = "json"
+	encodingBinary = "binary"
+)
+
+// The schema version of published entries. Receivers reject entries of another
+// major version, and accept any minor version, which only adds fields.
+const (
+	schemaMajor   = 1
+	schemaMinor   = 1
+	schemaVersion = "1.1"
+)
+
+const (
+	// binaryMagic starts every binary entry. JSON entries start with '{',
+	// so receivers tell the encodings apart and mixed clusters keep working.
+	binaryMagic = 0xdc
+	// binaryHeaderLen is magic, major and minor version, flags, type, class and time to die.
+	binaryHeaderLen = 1 + 1 + 1 + 1 + 2 + 2 + 8
+
+	flagDo    = 1 << 0
+	flagCd    = 1 << 1
+	flagError = 1 << 2
+	// flagResolving marks an announcement. Added in 1.1.
+	flagResolving = 1 << 3
+)
+
+var (
+	errShortEntry = errors.New("binary entry too short")
+	errSchema     = errors.New("unsupported schema version")
+	errIncomplete = errors.New("incomplete entry")
+	// errEncode marks an entry that cannot be encoded. The entry is at fault,
+	// not the transport, so it is left out of its batch.
+	errEncode      = errors.New("failed encode")
+	rejectLogLimit = newLogLimiter(time.Minute)
+	skipLogLimit   = newLogLimiter(time.Minute)
+)
+
+// checkVersion returns errSchema unless version has the major version this node understands.
+// Entries from peers that predate versioning carry no version and are read as 1.0.
+func checkVersion(version string) error {
+	if version == "" {
+		return nil
+	}
+	major := strings.SplitN(version, ".", 2)[0]
+	if major != strconv.Itoa(schemaMajor) {
+		return fmt.Errorf("%w %q", errSchema, version)
+	}
+	return nil
+}
+
+// MarshalBinary encodes a as a binary entry: a fixed header, the length
+// prefixed By, and Name and the response in wire format. A name in wire format
+// takes at most 255 octets, however long its presentation format is.
+func (a *AnswerCache) MarshalBinary() ([]byte, error) {
+	if len(a.By) > 0xff {
+		return nil, fmt.Errorf("id too long to encode: %q", a.By)
+	}
+
+	name := make([]byte, 256)
+	n, err := dns.PackDomainName(a.Name, name, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := a.Response.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var flags byte
+	if a.Do {
+		flags |= flagDo
+	}
+	if a.Cd {
+		flags |= flagCd
+	}
+	if a.Error {
+		flags |= flagError
+	}
+	if a.Resolving {
+		flags |= flagResolving
+	}
+
+	b := make([]byte, binaryHeaderLen, binaryHeaderLen+1+len(a.By)+n+len(msg))
+	b[0] = binaryMagic
+	b[1] = schemaMajor
+	b[2] = schemaMinor
+	b[3] = flags
+	binary.BigEndian.PutUint16(b[4:], uint16(a.Type))
+	binary.BigEndian.PutUint16(b[6:], uint16(a.Class))
+	binary.BigEndian.PutUint64(b[8:], uint64(a.TimeToDie))
+	b = append(b, byte(len(a.By)))
+	b = append(b, a.By...)
+	b = append(b, name[:n]...)
+	b = append(b, msg...)
+
+	return b, nil
+}
+
+// UnmarshalBinary decodes a binary entry made by MarshalBinary.
+func (a *AnswerCache) UnmarshalBinary(data []byte) error {
+	if len(data) < binaryHeaderLen {
+		return errShortEntry
+	}
+	if data[0] != binaryMagic {
+		return fmt.Errorf("not a binary entry: magic %#x", data[0])
+	}
+	if data[1] != schemaMajor {
+		return fmt.Errorf("%w %d.%d", errSchema, data[1], data[2])
+	}
+
+	flags := data[3]
+	a.Do = flags&flagDo != 0
+	a.Cd = flags&flagCd != 0
+	a.Error = flags&flagError != 0
+	a.Resolving = flags&flagResolving != 0
+	a.Type = dns.Type(binary.BigEndian.Uint16(data[4:]))
+	a.Class = dns.Class(binary.BigEndian.Uint16(data[6:]))
+	a.TimeToDie = int64(binary.BigEndian.Uint64(data[8:]))
+
+	rest := data[binaryHeaderLen:]
+	by, rest, err := readString(rest)
+	if err != nil {
+		return err
+	}
+	n, off, err := dns.UnpackDomainName(rest, 0)
+	if err != nil {
+		return err
+	}
+	a.By = by
+	a.Name = n
+
+	a.Response = &dns.Msg{}
+	return a.Response.Unpack(rest[off:])
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", nil, errShortEntry
+	}
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:], nil
+}
+
+// Key is a shared secret used to sign published entries.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Codec encodes entries for publishing and decodes received entries.
+type Codec struct {
+	// Encoding is the format of encoded entries. Decode reads every format.
+	Encoding string
+	// Keys sign encoded entries with the first key, and verify decoded entries
+	// with the key of the same ID. Without keys entries are not signed.
+	Keys []Key
+}
+
+// Encode encodes ans, and signs it when c has keys.
+func (c *Codec) Encode(ans *AnswerCache) ([]byte, error) {
+	var b []byte
+	var err error
+	if c.Encoding == encodingBinary {
+		b, err = ans.MarshalBinary()
+	} else {
+		b, err = ans.MarshalJSON()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %s", errEncode, ans.Name, err)
+	}
+	if len(c.Keys) == 0 {
+		return b, nil
+	}
+	return sign(c.Keys[0], b), nil
+}
+
+// Decode verifies the signature of data when c has keys, then decodes it.
+func (c *Codec) Decode(data []byte) (*AnswerCache, error) {
+	if len(c.Keys) > 0 || (len(data) > 0 && data[0] == signedMagic) {
+		var err error
+		if data, err = verify(c.Keys, data); err != nil {
+			return nil, err
+		}
+	}
+	return decodeAnswer(data)
+}
+
+// decodeAnswer decodes an entry in either encoding, and rejects entries
+// missing a field every version sets.
+func decodeAnswer(data []byte) (*AnswerCache, error) {
+	ans := &AnswerCache{}
+	var err error
+	if len(data) > 0 && data[0] == binaryMagic {
+		err = ans.UnmarshalBinary(data)
+	} else {
+		err = json.Unmarshal(data, ans)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ans.Name == "" || ans.Type == 0 || ans.TimeToDie <= 0 || ans.Response == nil {
+		return nil, fmt.Errorf("%w: name %q type %d time to die %d", errIncomplete, ans.Name, ans.Type, ans.TimeToDie)
+	}
+	return ans, nil
+}
+
+// rejectEntry records a received entry that could not be decoded or validated.
+// Logging is rate limited, as a peer on another version rejects every entry.
+// skipEntry counts and logs an entry left out of a publish because encoding
+// it failed with err.
+func skipEntry(ctx context.Context, log clog.P, err error) {
+	encodeErrors.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	skipLogLimit.Warningf(log, "skip entry: %s", err)
+}
+
+func rejectEntry(ctx context.Context, log clog.P, err error) {
+	s := metrics.WithServer(ctx)
+	switch {
+	case errors.Is(err, errSignature):
+		signatureRejected.WithLabelValues(s).Inc()
+	case errors.Is(err, errSchema), errors.Is(err, errIncomplete):
+		schemaRejected.WithLabelValues(s).Inc()
+	case errors.Is(err, errInvalid):
+		validationRejected.WithLabelValues(s).Inc()
+	}
+	rejectLogLimit.Warningf(log, "reject received entry: %s", err)
+}
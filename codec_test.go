@@ -0,0 +1,164 @@
+package dcache
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/goccy/go-json"
+	"github.com/miekg/dns"
+)
+
+func testCodecAnswer() *AnswerCache {
+	m := new(dns.Msg)
+	m.SetQuestion("bootjp.me.", dns.TypeMX)
+	m.Answer = []dns.RR{
+		test.MX("bootjp.me.	3600	IN	MX	1 aspmx.l.google.com."),
+		test.MX("bootjp.me.	3600	IN	MX	10 aspmx2.googlemail.com."),
+	}
+	return &AnswerCache{
+		Name:      "bootjp.me.",
+		Response:  m,
+		Type:      dns.Type(dns.TypeMX),
+		Class:     dns.Class(dns.ClassINET),
+		Do:        true,
+		Cd:        true,
+		TimeToDie: 1700000000,
+		By:        "node-a",
+		Error:     true,
+	}
+}
+
+func TestCodec(t *testing.T) {
+	want := testCodecAnswer()
+	want.Resolving = true
+
+	for _, encoding := range []string{encodingJSON, encodingBinary} {
+		b, err := (&Codec{Encoding: encoding}).Encode(want)
+		if err != nil {
+			t.Fatalf("%s: failed encode %s", encoding, err)
+		}
+		got, err := decodeAnswer(b)
+		if err != nil {
+			t.Fatalf("%s: failed decode %s", encoding, err)
+		}
+
+		if got.Name != want.Name || got.Type != want.Type || got.Class != want.Class ||
+			got.Do != want.Do || got.Cd != want.Cd || got.TimeToDie != want.TimeToDie ||
+			got.By != want.By || got.Error != want.Error || got.Resolving != want.Resolving {
+			t.Errorf("%s: expected %+v, got %+v", encoding, want, got)
+		}
+		if len(got.Response.Answer) != 2 || got.Response.Answer[0].String() != want.Response.Answer[0].String() {
+			t.Errorf("%s: expected response %v, got %v", encoding, want.Response, got.Response)
+		}
+	}
+
+	b, _ := want.MarshalBinary()
+	for _, bad := range [][]byte{b[:5], b[:binaryHeaderLen+3], append([]byte{binaryMagic, 99}, b[2:]...)} {
+		if _, err := decodeAnswer(bad); err == nil {
+			t.Errorf("Expected error decoding %v", bad)
+		}
+	}
+}
+
+func TestCodecLongName(t *testing.T) {
+	// A name of 255 octets of \000 labels is about 1000 characters long.
+	label := strings.Repeat(`\000`, 63)
+	qname := label + "." + label + "." + label + "." + strings.Repeat(`\000`, 61) + "."
+	want := testCodecAnswer()
+	want.Name = qname
+	want.Response.SetQuestion(qname, dns.TypeMX)
+	want.Response.Answer = nil
+
+	b, err := (&Codec{Encoding: encodingBinary}).Encode(want)
+	if err != nil {
+		t.Fatalf("failed encode %s", err)
+	}
+	got, err := decodeAnswer(b)
+	if err != nil {
+		t.Fatalf("failed decode %s", err)
+	}
+	if got.Name != qname {
+		t.Errorf("Expected %s, got %s", qname, got.Name)
+	}
+}
+
+func TestCodecVersion(t *testing.T) {
+	ans := testCodecAnswer()
+	b, err := ans.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ans.Response.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _ := json.Marshal(msg)
+
+	tests := []struct {
+		payload string
+		err     error
+	}{
+		{string(b), nil},
+		{strings.Replace(string(b), `"Version":"`+schemaVersion+`"`, `"Version":"1.7"`, 1), nil},
+		{strings.Replace(string(b), `"Version":"`+schemaVersion+`"`, `"Version":"2.0"`, 1), errSchema},
+		// Entries from peers that predate versioning.
+		{`{"Name":"bootjp.me.","Type":15,"TimeToDie":1700000000,"Response":` + string(response) + `}`, nil},
+		{`{"Name":"bootjp.me.","Type":15,"Response":` + string(response) + `}`, errIncomplete},
+		{`{"Response":` + string(response) + `}`, errIncomplete},
+	}
+
+	for i, tc := range tests {
+		_, err := decodeAnswer([]byte(tc.payload))
+		if tc.err == nil && err != nil {
+			t.Errorf("Test %d: expected no error, got %s", i, err)
+		}
+		if tc.err != nil && !errors.Is(err, tc.err) {
+			t.Errorf("Test %d: expected %s, got %v", i, tc.err, err)
+		}
+	}
+
+	bin, err := ans.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin[1] = schemaMajor + 1
+	if _, err := decodeAnswer(bin); !errors.Is(err, errSchema) {
+		t.Errorf("Expected %s for binary entry, got %v", errSchema, err)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	ans := testCodecAnswer()
+	for _, encoding := range []string{encodingJSON, encodingBinary} {
+		b.Run(encoding, func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				p, err := (&Codec{Encoding: encoding}).Encode(ans)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(p)
+			}
+			b.ReportMetric(float64(size), "bytes/entry")
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	ans := testCodecAnswer()
+	for _, encoding := range []string{encodingJSON, encodingBinary} {
+		p, err := (&Codec{Encoding: encoding}).Encode(ans)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(encoding, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeAnswer(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -2,15 +2,19 @@ package dcache
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"hash/fnv"
 	"math"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	gonanoid "github.com/matoous/go-nanoid"
 
-	"github.com/oleiade/lane"
-
+	"github.com/coredns/coredns/plugin/cache/freq"
 	"github.com/coredns/coredns/plugin/pkg/cache"
 
 	"github.com/coredns/coredns/plugin/metrics"
@@ -18,7 +22,7 @@ import (
 	"github.com/goccy/go-json"
 
 	"github.com/coredns/coredns/plugin/pkg/response"
-	"github.com/go-redis/redis/v8"
+	"github.com/redis/go-redis/v9"
 
 	"github.com/coredns/coredns/request"
 
@@ -30,189 +34,808 @@ import (
 
 const name = "dcache"
 
+const (
+	startupFail     = "fail"
+	startupContinue = "continue"
+)
+
+const (
+	defaultCapacity   = 10000
+	defaultQueueLimit = 10000
+	defaultWorkers    = 4
+	// drainTimeout bounds the time spent publishing the queue at shutdown.
+	drainTimeout = 5 * time.Second
+	// defaultPrefetchDuration and defaultPrefetchPercentage apply to prefetch without them.
+	defaultPrefetchDuration   = time.Minute
+	defaultPrefetchPercentage = 10
+	// defaultServeStale is the stale window of serve_stale without an argument.
+	defaultServeStale = time.Hour
+	// staleTTL is the TTL of a stale answer, as RFC 8767 recommends.
+	staleTTL = 30
+	// defaultErrorMinTTL and defaultErrorMaxTTL bound the lifetime of an
+	// error entry, as the denial cache of the CoreDNS cache plugin does.
+	defaultErrorMinTTL = 5 * time.Second
+	defaultErrorMaxTTL = 30 * time.Minute
+	// defaultLookup is the time budget of lookup without an argument.
+	defaultLookup = 10 * time.Millisecond
+)
+
 // Dcache is a plugin that distribute shard successCache.
 type Dcache struct {
 	init bool
 	Addr string
 	Next plugin.Handler
 
-	log          clog.P
-	id           string
-	successCache *CacheRepository
-	errorCache   *CacheRepository
-	subscribeCon *redis.Client
-	publishCon   *redis.Client
-	queue        *lane.Queue
+	// Transport shares entries with the other nodes.
+	Transport Transport
+	// TransportType selects the Transport built by connect.
+	TransportType string
+	// Encoding is the format of published entries. Entries are received in any format.
+	Encoding string
+	// Keys sign and verify published entries. The first key signs.
+	Keys []Key
+	// Addrs are the sentinels or cluster nodes after Addr.
+	Addrs []string
+	// MasterName selects Sentinel mode: Addr and Addrs are sentinels monitoring this master.
+	MasterName string
+	// Cluster selects Redis Cluster mode: Addr and Addrs are seed nodes of the cluster.
+	Cluster bool
+	// Channel is the redis Pub/Sub channel name shared by the cluster.
+	Channel string
+	// Username and Password authenticate to Redis, Username with a Redis 6 ACL user.
+	Username string
+	Password string
+	DB       int
+	// TLSConfig enables TLS to Redis when set.
+	TLSConfig *tls.Config
+	// StreamMaxLen is the approximate number of entries kept by the stream transport.
+	StreamMaxLen int64
+	// Replay is the window of entries a new node reads from the stream transport.
+	Replay time.Duration
+	// Snapshot keeps published entries in Redis so a new node can load them at startup.
+	Snapshot bool
+	// QueueLimit is the maximum number of entries waiting to be published.
+	QueueLimit int
+	// QueuePolicy decides which entry is dropped when the publish queue is full.
+	QueuePolicy string
+	// Workers is the number of routines publishing concurrently, and the size of the publish connection pool.
+	Workers int
+	// BatchSize is the maximum number of entries sent in one round trip.
+	BatchSize int
+	// BatchWindow is how long a worker waits for a batch to fill. Zero sends what is queued at once.
+	BatchWindow time.Duration
+	// MinTTL and MaxTTL bound the lifetime of a shared entry. Zero MaxTTL means no upper bound.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// ErrorMinTTL and ErrorMaxTTL bound the lifetime of an entry in the error cache
+	// after MinTTL and MaxTTL. ErrorMaxTTL also bounds the entries of peers, and
+	// ErrorMinTTL is the lifetime of an answer without a TTL to go by.
+	ErrorMinTTL time.Duration
+	ErrorMaxTTL time.Duration
+	// Zones restricts the zones served from the cache. Empty means all zones.
+	Zones []string
+	// Startup decides whether startup fails or continues when Redis is unreachable.
+	Startup string
+	// Prefetch is the number of hits within PrefetchDuration that makes an entry
+	// popular. Zero disables prefetching.
+	Prefetch         int
+	PrefetchDuration time.Duration
+	// PrefetchPercentage is the percentage of its lifetime left at which a popular entry is resolved again.
+	PrefetchPercentage int
+	// ServeStale is how long expired entries are kept, and served when the next
+	// plugin fails. Zero disables serving stale.
+	ServeStale time.Duration
+	// Coalesce is how long a miss waits for the answer to a question a peer
+	// announced it is resolving. Zero disables coalescing.
+	Coalesce time.Duration
+	// Lookup is the time budget of reading an entry missing on this node from
+	// the snapshot before resolving it. Zero disables lookups.
+	Lookup time.Duration
+
+	log           clog.P
+	id            string
+	successCache  *CacheRepository
+	errorCache    *CacheRepository
+	queue         *publishQueue
+	flights       *flights
+	announcements chan *AnswerCache
+	health        *Health
+	snapshot      *RedisSnapshot
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
 }
 
 func New(host string) *Dcache {
-	s, _ := NewCacheRepository(10000)
-	e, _ := NewCacheRepository(10000)
+	s, _ := NewCacheRepository(defaultCapacity)
+	e, _ := NewCacheRepository(defaultCapacity)
 
 	return &Dcache{
-		Addr:         host,
-		successCache: s,
-		errorCache:   e,
-		id:           gonanoid.MustID(10),
-		queue:        lane.NewQueue(),
+		Addr:               host,
+		Channel:            name,
+		TransportType:      transportRedis,
+		Encoding:           encodingJSON,
+		StreamMaxLen:       defaultStreamMaxLen,
+		QueueLimit:         defaultQueueLimit,
+		QueuePolicy:        dropNewest,
+		Workers:            defaultWorkers,
+		BatchSize:          1,
+		Startup:            startupFail,
+		PrefetchDuration:   defaultPrefetchDuration,
+		PrefetchPercentage: defaultPrefetchPercentage,
+		ErrorMinTTL:        defaultErrorMinTTL,
+		ErrorMaxTTL:        defaultErrorMaxTTL,
+		successCache:       s,
+		errorCache:         e,
+		id:                 gonanoid.MustID(10),
+		queue:              newPublishQueue(),
+		flights:            newFlights(),
+		announcements:      make(chan *AnswerCache, announceQueue),
 	}
 }
 
 // ServeDNS implements the plugin.Handler interface.
 func (d *Dcache) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := &request.Request{Req: r, W: w}
+	if len(d.Zones) > 0 && plugin.Zones(d.Zones).Matches(state.Name()) == "" {
+		return plugin.NextOrFailure(d.Name(), d.Next, ctx, w, r)
+	}
+
 	unix := time.Now().UTC().Unix()
+	if d.fromCache(ctx, w, r, state, unix) {
+		return dns.RcodeSuccess, nil
+	}
+
+	cacheMisses.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	if ans, ok := d.lookup(ctx, state, unix); ok {
+		_ = w.WriteMsg(ans.toMsg(r, unix))
+		return dns.RcodeSuccess, nil
+	}
+	if d.Coalesce > 0 {
+		key := requestKey(state)
+		// A flight ending without an answer, such as the announcement of a
+		// peer timing out, is followed by one more: the first waiter leads it.
+		for i := 0; i < 2; i++ {
+			done, leader := d.flights.begin(key)
+			if leader {
+				defer d.flights.end(key, done)
+				d.announce(state)
+				break
+			}
+			if d.await(ctx, w, r, state, done) {
+				return dns.RcodeSuccess, nil
+			}
+		}
+	}
+
 	rw := NewResponsePrinter(w, d.log, d, *state)
+	if d.ServeStale > 0 {
+		if stale, ok := d.getStale(unix, state); ok {
+			return d.resolveOrStale(ctx, w, r, rw, stale)
+		}
+	}
+	return plugin.NextOrFailure(d.Name(), d.Next, ctx, rw, r)
+}
+
+// fromCache answers r from the errorCache or successCache, and reports
+// whether it did.
+func (d *Dcache) fromCache(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state *request.Request, unix int64) bool {
 	s := metrics.WithServer(ctx)
 
 	cr, eHit := d.errorCache.Get(unix, state)
+	if eHit && d.ServeStale > 0 && cr.Response.Rcode == dns.RcodeServerFailure {
+		// A failure of the upstream shared by a peer is answered like our own.
+		if stale, ok := d.getStale(unix, state); ok {
+			_, _ = d.writeStale(ctx, w, r, stale)
+			return true
+		}
+	}
 	if eHit {
 		d.log.Debug("errorCache hit")
 		cacheHits.WithLabelValues(s).Inc()
-		cr.Response.SetReply(r)
-		_ = w.WriteMsg(cr.Response)
-		return dns.RcodeSuccess, nil
+		_ = w.WriteMsg(cr.toMsg(r, unix))
+		d.prefetchIfPopular(ctx, *state, cr)
+		return true
 	}
 
 	cr, sHit := d.successCache.Get(unix, state)
 	if sHit {
 		d.log.Debug("successCache hit")
 		cacheHits.WithLabelValues(s).Inc()
-		cr.Response.SetReply(r)
-		_ = w.WriteMsg(cr.Response)
-		return dns.RcodeSuccess, nil
+		_ = w.WriteMsg(cr.toMsg(r, unix))
+		d.prefetchIfPopular(ctx, *state, cr)
+		return true
 	}
+	return false
+}
 
-	cacheMisses.WithLabelValues(s).Inc()
-	return plugin.NextOrFailure(d.Name(), d.Next, ctx, rw, r)
+// lookup reads the entry for state from the snapshot within the Lookup
+// budget, and stores it on this node. It finds the entries a peer published
+// while this node was not listening, or whose publication was lost.
+func (d *Dcache) lookup(ctx context.Context, state *request.Request, unix int64) (*AnswerCache, bool) {
+	// connect sets the snapshot before Health leaves StateConnecting.
+	if d.Lookup <= 0 || d.health == nil || d.health.State() == StateConnecting || d.snapshot == nil {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.Lookup)
+	defer cancel()
+	s := metrics.WithServer(ctx)
+
+	ans, ok, err := d.snapshot.Get(ctx, unix, requestKey(state))
+	if err != nil {
+		lookupErrors.WithLabelValues(s).Inc()
+		d.log.Debugf("failed lookup %s %s", state.Name(), err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	if err := validate(ans); err != nil {
+		rejectEntry(ctx, d.log, err)
+		return nil, false
+	}
+	// The snapshot holds the entry, so there is nothing to publish.
+	if err := d.store(ans); err != nil {
+		d.log.Errorf("cache set failed got %v err %s", ans, err)
+	}
+
+	lookupHits.WithLabelValues(s).Inc()
+	return ans, true
 }
 
-func (d *Dcache) connect() error {
-	ctx := context.Background()
+// prefetchIfPopular counts a hit on cr, and resolves it again in the
+// background when it is popular and about to expire.
+func (d *Dcache) prefetchIfPopular(ctx context.Context, state request.Request, cr *AnswerCache) {
+	if d.Prefetch <= 0 || cr.freq == nil {
+		return
+	}
 
-	d.publishCon = redis.NewClient(&redis.Options{
-		Addr:     d.Addr,
-		PoolSize: 1,
-	})
+	now := time.Now()
+	hits := cr.freq.Update(d.PrefetchDuration, now)
+	threshold := int64(math.Ceil(float64(d.PrefetchPercentage) / 100 * float64(cr.TimeToDie-cr.stored)))
+	if hits < d.Prefetch || cr.TimeToDie-now.Unix() > threshold {
+		return
+	}
+	// One prefetch per entry at a time.
+	if !atomic.CompareAndSwapInt32(&cr.prefetching, 0, 1) {
+		return
+	}
 
-	d.subscribeCon = redis.NewClient(&redis.Options{
-		Addr:     d.Addr,
-		PoolSize: 1,
-	})
+	go d.doPrefetch(ctx, state, cr, now)
+}
 
-	if cmd := d.subscribeCon.Ping(ctx); cmd.Err() != nil {
-		d.log.Error("failed connect redis", cmd.Err())
-		return cmd.Err()
+// doPrefetch resolves the question of state with the next plugin. The answer
+// is stored and published like any other, so the whole cluster renews the
+// entry from a single resolution.
+func (d *Dcache) doPrefetch(ctx context.Context, state request.Request, cr *AnswerCache, now time.Time) {
+	defer atomic.StoreInt32(&cr.prefetching, 0)
+	prefetches.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+	state.Req = state.Req.Copy()
+	rw := NewResponsePrinter(state.W, d.log, d, state)
+	rw.prefetch = true
+	// The address type decides the response size, and TCP avoids truncating it.
+	rw.remoteAddr = state.W.RemoteAddr()
+	if u, ok := rw.remoteAddr.(*net.UDPAddr); ok {
+		rw.remoteAddr = &net.TCPAddr{IP: u.IP, Port: u.Port, Zone: u.Zone}
 	}
 
-	if cmd := d.publishCon.Ping(ctx); cmd.Err() != nil {
-		d.log.Error("failed connect redis", cmd.Err())
-		return cmd.Err()
+	if _, err := plugin.NextOrFailure(d.Name(), d.Next, ctx, rw, state.Req); err != nil {
+		d.log.Debugf("failed prefetch %s %s", state.Name(), err)
+	}
+
+	// The renewed entry keeps the hits of the entry it replaces.
+	unix := now.Unix()
+	for _, c := range []*CacheRepository{d.successCache, d.errorCache} {
+		if n, ok := c.Get(unix, &state); ok && n != cr && n.freq != nil {
+			n.freq.Reset(now, cr.freq.Hits())
+		}
+	}
+}
+
+// getStale returns the expired entry for state kept for serving stale.
+// Cached failures are not worth serving.
+func (d *Dcache) getStale(now int64, state *request.Request) (*AnswerCache, bool) {
+	var stale *AnswerCache
+	for _, c := range []*CacheRepository{d.successCache, d.errorCache} {
+		cr, ok := c.GetStale(now, state)
+		if !ok || cr.Response.Rcode == dns.RcodeServerFailure {
+			continue
+		}
+		if stale == nil || cr.TimeToDie > stale.TimeToDie {
+			stale = cr
+		}
+	}
+	return stale, stale != nil
+}
+
+// resolveOrStale resolves r with the next plugin, and answers from stale
+// when the next plugin fails with SERVFAIL or times out.
+func (d *Dcache) resolveOrStale(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, rw *ResponseWriter, stale *AnswerCache) (int, error) {
+	rw.stale = true
+	rcode, err := plugin.NextOrFailure(d.Name(), d.Next, ctx, rw, r)
+
+	// A plugin returning SERVFAIL, as forward does on a timeout, did not write.
+	if !rw.failed && rcode != dns.RcodeServerFailure {
+		return rcode, err
+	}
+	if err != nil {
+		d.log.Debugf("serve stale %s after %s", rw.state.Name(), err)
+	}
+	return d.writeStale(ctx, w, r, stale)
+}
+
+// writeStale answers r from the expired entry stale with staleTTL.
+func (d *Dcache) writeStale(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, stale *AnswerCache) (int, error) {
+	servedStale.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	_ = w.WriteMsg(stale.reply(r, staleTTL))
+	return dns.RcodeSuccess, nil
+}
+
+func (d *Dcache) connect() error {
+	switch d.TransportType {
+	case transportMemory:
+		d.Transport = NewMemoryTransport(memoryBus)
+	case transportStream:
+		t, err := NewStreamTransport(d.redisOptions(), d.Channel, d.codec(), d.StreamMaxLen, d.Replay, d.health, d.log)
+		if err != nil {
+			return err
+		}
+		d.Transport = t
+	default:
+		t, err := NewRedisTransport(d.redisOptions(), d.Channel, d.codec(), d.health, d.log)
+		if err != nil {
+			return err
+		}
+		d.Transport = t
+	}
+
+	if d.Snapshot {
+		s, err := NewRedisSnapshot(d.redisOptions(), d.Channel+":snapshot:", d.codec(), d.log)
+		if err != nil {
+			_ = d.Transport.Close()
+			d.Transport = nil
+			return err
+		}
+		d.snapshot = s
 	}
 
 	return nil
 }
 
+// loadSnapshot fills the caches of this node with the entries in the snapshot.
+func (d *Dcache) loadSnapshot() error {
+	if d.snapshot == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotLoadTimeout)
+	defer cancel()
+
+	n, err := d.snapshot.Load(ctx, time.Now().UTC().Unix(), func(ans *AnswerCache) {
+		if err := validate(ans); err != nil {
+			rejectEntry(ctx, d.log, err)
+			return
+		}
+		if err := d.store(ans); err != nil {
+			d.log.Errorf("cache set failed got %v err %s", ans, err)
+		}
+	})
+	d.log.Infof("loaded %d entries from snapshot", n)
+	return err
+}
+
+func (d *Dcache) codec() *Codec {
+	return &Codec{
+		Encoding: d.Encoding,
+		Keys:     d.Keys,
+	}
+}
+
+// redisOptions describes the Redis deployment. TLS verifies the name of each
+// server dialed, which is what a Sentinel or Cluster deployment needs.
+func (d *Dcache) redisOptions() *RedisOptions {
+	return &RedisOptions{
+		UniversalOptions: redis.UniversalOptions{
+			Addrs:      append([]string{d.Addr}, d.Addrs...),
+			MasterName: d.MasterName,
+			Username:   d.Username,
+			Password:   d.Password,
+			DB:         d.DB,
+			PoolSize:   d.Workers,
+			TLSConfig:  d.TLSConfig,
+		},
+		ClusterMode: d.Cluster,
+	}
+}
+
 // Name implements the Handler interface.
 func (d *Dcache) Name() string {
 	return name
 }
 
-func (d *Dcache) runSubscribe() {
-	d.log.Info("start distribute cache receive routine")
-	defer func() {
-		_ = d.subscribeCon.Close()
-	}()
-	ctx := context.Background()
+// startup connects the transport and starts the receive and publish routines.
+// When Redis is unreachable, it fails unless Startup is startupContinue, in which
+// case the node serves from its local cache and connects in the background.
+func (d *Dcache) startup() error {
+	d.health = NewHealth(d.log)
+	ctx, cancel := context.WithCancel(context.Background())
+	connectionState.WithLabelValues(metrics.WithServer(ctx)).Set(float64(StateConnecting))
+
+	err := d.connect()
+	if err != nil && d.Startup != startupContinue {
+		cancel()
+		return err
+	}
+	d.cancel = cancel
 
-	sub := d.subscribeCon.Subscribe(ctx, d.Name())
+	if err != nil {
+		d.log.Warningf("failed connect %s, serving from the local cache until connected", err)
+		d.health.Report(ctx, routineConnect, err)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.reconnect(ctx)
+		}()
+		return nil
+	}
+
+	d.health.Report(ctx, routineConnect, nil)
+	d.run(ctx)
+	return nil
+}
+
+// reconnect retries connect with backoff until it succeeds or ctx is done,
+// and then starts the routines.
+func (d *Dcache) reconnect(ctx context.Context) {
+	b := retryBackoff
 	for {
-		m, err := sub.ReceiveMessage(ctx)
-		if err != nil {
-			d.log.Errorf("failed receive %s", err)
-			s := metrics.WithServer(ctx)
-			redisErr.WithLabelValues(s).Inc()
-			time.Sleep(10 * time.Second)
-			continue
+		if !sleep(ctx, b.next()) {
+			return
+		}
+		err := d.connect()
+		if err == nil {
+			break
 		}
+		d.health.Report(ctx, routineConnect, err)
+	}
 
-		d.log.Debug("receive message", m.String())
+	d.health.Report(ctx, routineConnect, nil)
+	d.run(ctx)
+}
 
-		ans := &AnswerCache{}
-		if err := json.Unmarshal([]byte(m.Payload), ans); err != nil {
-			d.log.Errorf("error unmarshal %s got %v", err, ans)
-			continue
+// run starts the receive and publish routines on the connected transport,
+// and loads the snapshot.
+func (d *Dcache) run(ctx context.Context) {
+	// Subscribe returns once subscribed: entries published from now on arrive
+	// through the subscription, so loading the snapshot after it leaves no gap.
+	sub := d.Transport.Subscribe(ctx)
+
+	d.wg.Add(1 + d.Workers)
+	go func() {
+		defer d.wg.Done()
+		d.runSubscribe(ctx, sub)
+	}()
+	if d.Coalesce > 0 {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.runAnnounce(ctx)
+		}()
+	}
+	for i := 0; i < d.Workers; i++ {
+		go func() {
+			defer d.wg.Done()
+			d.runPublish(ctx)
+		}()
+	}
+
+	if err := d.loadSnapshot(); err != nil {
+		d.log.Errorf("failed load snapshot %s", err)
+	}
+}
+
+// shutdown stops the routines started by startup, publishes the entries left
+// in the queue within drainTimeout and closes the transport.
+func (d *Dcache) shutdown() error {
+	if d.cancel == nil {
+		return nil
+	}
+	d.cancel()
+	d.wg.Wait()
+	d.cancel = nil
+
+	// Redis was never reached.
+	if d.Transport == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	for ctx.Err() == nil {
+		batch := d.dequeueBatch()
+		if len(batch) == 0 {
+			break
+		}
+		if err := d.publish(ctx, batch...); err != nil {
+			break
 		}
+	}
+
+	if d.snapshot != nil {
+		_ = d.snapshot.Close()
+	}
+	return d.Transport.Close()
+}
+
+// runSubscribe stores the entries received on sub until it is closed.
+func (d *Dcache) runSubscribe(ctx context.Context, sub <-chan *AnswerCache) {
+	d.log.Info("start distribute cache receive routine")
 
+	for ans := range sub {
 		if d.id == ans.By {
 			d.log.Debug("ignore own cache")
 			continue
 		}
 
-		if ans.Error {
-			if err = d.errorCache.Set(ans); err != nil {
-				d.log.Errorf("error cache set failed got %v err %s", m, err)
-				d.log.Error(err)
-			}
+		if err := validate(ans); err != nil {
+			rejectEntry(ctx, d.log, err)
 			continue
 		}
 
-		if err = d.successCache.Set(ans); err != nil {
-			d.log.Errorf("success cache set failed got %v err %s", m, err)
-			d.log.Error(err)
+		if ans.Resolving {
+			d.announced(ans)
 			continue
 		}
+
+		if err := d.store(ans); err != nil {
+			d.log.Errorf("cache set failed got %v err %s", ans, err)
+			continue
+		}
+	}
+}
+
+// store inserts ans into the errorCache or successCache of this node.
+// The flight for its question ends, so misses waiting for it read the answer.
+// Error entries living longer than ErrorMaxTTL, such as entries of peers
+// that cache negative answers without a bound, are shortened.
+func (d *Dcache) store(ans *AnswerCache) error {
+	defer d.flights.end(ans.key(), nil)
+	if ans.Error {
+		if max := time.Now().UTC().Add(d.ErrorMaxTTL).Unix(); d.ErrorMaxTTL > 0 && ans.TimeToDie > max {
+			// ans may be shared with other receivers, so a copy is shortened.
+			capped := *ans
+			capped.TimeToDie = max
+			ans = &capped
+		}
+		return d.errorCache.Set(ans)
+	}
+	return d.successCache.Set(ans)
+}
+
+// writeThrough caches ans on this node and queues it for the other nodes.
+func (d *Dcache) writeThrough(ans *AnswerCache) {
+	if err := d.store(ans); err != nil {
+		d.log.Errorf("local cache set failed got %v err %s", ans, err)
 	}
+
+	d.enqueue(ans)
 }
 
 func (d *Dcache) minTTL(msg *dns.Msg) uint32 {
+	return minRRTTL(msg.Answer)
+}
+
+// minRRTTL returns the smallest TTL of rrs, or math.MaxUint32 when rrs is empty.
+func minRRTTL(rrs []dns.RR) uint32 {
 	min := uint32(math.MaxUint32)
-	for _, ans := range msg.Answer {
-		if min > ans.Header().Ttl {
-			min = ans.Header().Ttl
+	for _, rr := range rrs {
+		if min > rr.Header().Ttl {
+			min = rr.Header().Ttl
 		}
 	}
 
 	return min
 }
-func (d *Dcache) publish(ans *AnswerCache) {
 
-	// truncated data not cache.
-	if ans.Response.Truncated {
-		return
+// ttl returns the lifetime of an entry for msg of type mt. The lifetime of a
+// negative answer is its negative TTL, a delegation lives for the TTL of its
+// authority section, and an answer without records to take a TTL from lives
+// for ErrorMinTTL.
+func (d *Dcache) ttl(msg *dns.Msg, mt response.Type) time.Duration {
+	isError := mt == response.NameError || mt == response.NoData || mt == response.ServerError
+
+	ttl := time.Duration(d.minTTL(msg)) * time.Second
+	switch {
+	case isError:
+		ttl = d.ErrorMinTTL
+		if n, ok := negativeTTL(msg); ok {
+			ttl = time.Duration(n) * time.Second
+		}
+	case mt == response.Delegation:
+		ttl = time.Duration(minRRTTL(msg.Ns)) * time.Second
+	case len(msg.Answer) == 0:
+		// An empty NOERROR without an SOA record has no negative TTL (RFC 2308 section 5).
+		ttl = d.ErrorMinTTL
 	}
 
-	ctx := context.Background()
+	if ttl < d.MinTTL {
+		ttl = d.MinTTL
+	}
+	if d.MaxTTL > 0 && ttl > d.MaxTTL {
+		ttl = d.MaxTTL
+	}
+	if !isError {
+		return ttl
+	}
 
-	b, err := ans.MarshalJSON()
-	if err != nil {
-		d.log.Errorf("failed marshal %s %v", err, ans)
-		return
+	if ttl < d.ErrorMinTTL {
+		ttl = d.ErrorMinTTL
+	}
+	if d.ErrorMaxTTL > 0 && ttl > d.ErrorMaxTTL {
+		ttl = d.ErrorMaxTTL
+	}
+	return ttl
+}
+
+// negativeTTL returns the TTL of a negative answer as RFC 2308 section 5
+// defines it: the smaller of the TTL and the MINIMUM field of the SOA record
+// in the authority section.
+func negativeTTL(msg *dns.Msg) (uint32, bool) {
+	for _, rr := range msg.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		if soa.Minttl < soa.Hdr.Ttl {
+			return soa.Minttl, true
+		}
+		return soa.Hdr.Ttl, true
+	}
+	return 0, false
+}
+
+// enqueue adds ans to the publish queue. When the queue is full an entry is
+// dropped according to QueuePolicy.
+func (d *Dcache) enqueue(ans *AnswerCache) {
+	s := metrics.WithServer(context.Background())
+	if n := d.queue.push(ans, d.QueueLimit, d.QueuePolicy); n > 0 {
+		d.log.Debugf("publish queue is full, drop %d entries", n)
+		publishDropped.WithLabelValues(s).Add(float64(n))
+	}
+	publishQueueDepth.WithLabelValues(s).Set(float64(d.queue.len()))
+}
+
+// dequeue removes the next entry to publish, or returns nil when the queue is empty.
+func (d *Dcache) dequeue() *AnswerCache {
+	ans := d.queue.pop()
+	if ans != nil {
+		s := metrics.WithServer(context.Background())
+		publishQueueDepth.WithLabelValues(s).Set(float64(d.queue.len()))
+	}
+	return ans
+}
+
+// dequeueBatch removes up to BatchSize entries from the queue.
+func (d *Dcache) dequeueBatch() []*AnswerCache {
+	var batch []*AnswerCache
+	for len(batch) < d.BatchSize {
+		ans := d.dequeue()
+		if ans == nil {
+			break
+		}
+		batch = append(batch, ans)
+	}
+	return batch
+}
+
+func (d *Dcache) publish(ctx context.Context, batch ...*AnswerCache) error {
+	ans := make([]*AnswerCache, 0, len(batch))
+	for _, a := range batch {
+		// truncated data not cache.
+		if a.Response.Truncated {
+			continue
+		}
+		ans = append(ans, a)
+	}
+	if len(ans) == 0 {
+		return nil
 	}
 
-	cmd := d.publishCon.Publish(ctx, d.Name(), string(b))
-	if cmd.Err() != nil {
+	var err error
+	if bp, ok := d.Transport.(BatchPublisher); ok && len(ans) > 1 {
+		err = bp.PublishBatch(ctx, ans)
+	} else {
+		for _, a := range ans {
+			err = d.Transport.Publish(ctx, a)
+			// An entry that cannot be encoded is skipped, the others are still published.
+			if errors.Is(err, errEncode) {
+				skipEntry(ctx, d.log, err)
+				err = nil
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
 		s := metrics.WithServer(ctx)
 		redisErr.WithLabelValues(s).Inc()
-		d.log.Errorf("error publish err %s", cmd.Err())
-		return
+		d.log.Errorf("error publish err %s", err)
+		d.health.Report(ctx, routinePublish, err)
+		return err
 	}
+
+	if d.snapshot != nil {
+		if err = d.snapshot.Save(ctx, ans...); err != nil {
+			s := metrics.WithServer(ctx)
+			redisErr.WithLabelValues(s).Inc()
+			d.log.Errorf("error save snapshot err %s", err)
+		}
+	}
+	d.health.Report(ctx, routinePublish, err)
+	return err
 }
 
-func (d *Dcache) runPublish() {
+// runPublish publishes queued entries until ctx is done.
+// A batch being published when ctx is done is still published.
+func (d *Dcache) runPublish(ctx context.Context) {
 	d.log.Info("start distribute cache publish routine")
+	b := retryBackoff
+	for ctx.Err() == nil {
+		batch := d.collect(ctx)
+		if len(batch) == 0 {
+			continue
+		}
+
+		// A failing Redis is retried with backoff rather than by every queued batch.
+		if err := d.publish(context.Background(), batch...); err != nil {
+			if !sleep(ctx, b.next()) {
+				return
+			}
+			continue
+		}
+		b.reset()
+	}
+}
+
+// collect waits for queued entries and returns up to BatchSize of them.
+// Once it holds an entry it waits at most BatchWindow for the batch to fill.
+// It returns what it holds when ctx is done.
+func (d *Dcache) collect(ctx context.Context) []*AnswerCache {
+	var batch []*AnswerCache
+	var window *time.Timer
+	var timeout <-chan time.Time
 	defer func() {
-		_ = d.publishCon.Close()
+		if window != nil {
+			window.Stop()
+		}
 	}()
+
 	for {
-		item := d.queue.Dequeue()
-		if item == nil {
-			time.Sleep(1 * time.Second)
-			continue
+		for len(batch) < d.BatchSize {
+			ans := d.dequeue()
+			if ans == nil {
+				break
+			}
+			batch = append(batch, ans)
 		}
 
-		ans := item.(*AnswerCache)
-		d.publish(ans)
+		if len(batch) >= d.BatchSize || (len(batch) > 0 && d.BatchWindow <= 0) {
+			return batch
+		}
+		if len(batch) > 0 && window == nil {
+			window = time.NewTimer(d.BatchWindow)
+			timeout = window.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return batch
+		case <-timeout:
+			return batch
+		case <-d.queue.ready:
+		}
 	}
 }
 
@@ -224,6 +847,9 @@ type ResponseWriter struct {
 	do         bool
 	prefetch   bool
 	remoteAddr net.Addr
+	// stale withholds a SERVFAIL response, which the caller answers from a stale entry.
+	stale  bool
+	failed bool
 }
 
 // RemoteAddr implements the dns.ResponseWriter interface.
@@ -244,8 +870,17 @@ func NewResponsePrinter(w dns.ResponseWriter, log clog.P, d *Dcache, state reque
 	}
 }
 
-// WriteMsg calls the underlying ResponseWriter's WriteMsg method and prints "example" to standard output.
+// WriteMsg caches res on this node, queues it for publishing and calls the underlying ResponseWriter's WriteMsg method.
 func (r *ResponseWriter) WriteMsg(res *dns.Msg) error {
+	if r.stale && res.Rcode == dns.RcodeServerFailure {
+		r.failed = true
+		return nil
+	}
+	// A failed prefetch leaves the entry being renewed in place.
+	if r.prefetch && res.Rcode == dns.RcodeServerFailure {
+		return nil
+	}
+
 	do := false
 	now := time.Now().UTC()
 	mt, opt := response.Typify(res, now)
@@ -257,12 +892,15 @@ func (r *ResponseWriter) WriteMsg(res *dns.Msg) error {
 	res.Ns = filterRRSlice(res.Ns, do)
 	res.Extra = filterRRSlice(res.Extra, do)
 
+	// res is handed to the next writer, so the publisher gets its own copy.
 	ans := &AnswerCache{
 		Name:      r.state.Name(),
 		Type:      dns.Type(res.Question[0].Qtype),
-		Do:        do,
-		Response:  res,
-		TimeToDie: now.Unix() + int64(r.cache.minTTL(res)),
+		Class:     dns.Class(r.state.QClass()),
+		Do:        r.state.Do(),
+		Cd:        r.state.Req.CheckingDisabled,
+		Response:  res.Copy(),
+		TimeToDie: now.Add(r.cache.ttl(res, mt)).Unix(),
 		By:        r.cache.id,
 	}
 
@@ -270,39 +908,58 @@ func (r *ResponseWriter) WriteMsg(res *dns.Msg) error {
 	case
 		response.NoError,
 		response.Delegation:
-		r.cache.queue.Enqueue(ans)
+		r.cache.writeThrough(ans)
 	case
 		response.NameError,
 		response.NoData,
 		response.ServerError:
 		ans.Error = true
-		r.cache.queue.Enqueue(ans)
+		r.cache.writeThrough(ans)
 	case response.OtherError:
 		// do not cache
 	default:
 		r.log.Warningf("unknown type %#v", mt)
 	}
 
+	// Nobody waits for the answer of a prefetch.
+	if r.prefetch {
+		return nil
+	}
 	return r.ResponseWriter.WriteMsg(res)
 }
 
 func NewCacheRepository(size int) (*CacheRepository, error) {
 	return &CacheRepository{
 		items: cache.New(size),
+		size:  size,
 	}, nil
 }
 
 type CacheRepository struct {
 	items *cache.Cache
+	// size is the configured capacity. The shards of items round it up.
+	size int
+	// stale is the number of seconds an entry is kept after it expires.
+	stale int64
 }
 type AnswerCache struct {
-	Name      string   `json:"name"`
-	Response  *dns.Msg `json:"response"`
-	Type      dns.Type `json:"type"`
-	Do        bool     `json:"do"`
-	TimeToDie int64    `json:"time_to_die"`
-	By        string   `json:"by"`
+	Name      string    `json:"name"`
+	Response  *dns.Msg  `json:"response"`
+	Type      dns.Type  `json:"type"`
+	Class     dns.Class `json:"class"`
+	Do        bool      `json:"do"`
+	Cd        bool      `json:"cd"`
+	TimeToDie int64     `json:"time_to_die"`
+	By        string    `json:"by"`
 	Error     bool
+	// Resolving marks an announcement that By is resolving the question,
+	// rather than an answer to it.
+	Resolving bool
+
+	// stored, freq and prefetching are kept by CacheRepository for prefetching.
+	stored      int64
+	freq        *freq.Freq
+	prefetching int32
 }
 
 func (a *AnswerCache) MarshalJSON() ([]byte, error) {
@@ -316,21 +973,29 @@ func (a *AnswerCache) MarshalJSON() ([]byte, error) {
 	}
 
 	return json.Marshal(&struct {
+		Version   string
 		Response  []byte
 		Type      dns.Type
+		Class     dns.Class
 		Do        bool
+		Cd        bool
 		TimeToDie int64
 		By        string
 		Error     bool
 		Name      string
+		Resolving bool `json:",omitempty"`
 	}{
+		Version:   schemaVersion,
 		Response:  b,
 		Type:      a.Type,
+		Class:     a.Class,
 		Do:        a.Do,
+		Cd:        a.Cd,
 		TimeToDie: a.TimeToDie,
 		By:        a.By,
 		Error:     a.Error,
 		Name:      a.Name,
+		Resolving: a.Resolving,
 	})
 }
 func (a *AnswerCache) UnmarshalJSON(data []byte) error {
@@ -339,16 +1004,22 @@ func (a *AnswerCache) UnmarshalJSON(data []byte) error {
 	}
 
 	ans := &struct {
+		Version   string
 		Type      dns.Type
+		Class     dns.Class
 		Do        bool
+		Cd        bool
 		TimeToDie int64
 		Response  []byte
 		By        string
 		Error     bool
 		Name      string
+		Resolving bool
 	}{
 		Type:      a.Type,
+		Class:     a.Class,
 		Do:        a.Do,
+		Cd:        a.Cd,
 		TimeToDie: a.TimeToDie,
 		By:        a.By,
 		Error:     a.Error,
@@ -358,34 +1029,110 @@ func (a *AnswerCache) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &ans); err != nil {
 		return err
 	}
+	if err := checkVersion(ans.Version); err != nil {
+		return err
+	}
 
 	a.Type = ans.Type
+	a.Class = ans.Class
 	a.Do = ans.Do
+	a.Cd = ans.Cd
 	a.TimeToDie = ans.TimeToDie
 	a.Response = &dns.Msg{}
 	a.By = ans.By
 	a.Name = ans.Name
 	a.Error = ans.Error
+	a.Resolving = ans.Resolving
 	return a.Response.Unpack(ans.Response)
 }
 
+// key returns the hash identifying the question ans answers.
+func (a *AnswerCache) key() uint64 {
+	return hash(strings.ToLower(a.Name), uint16(a.Type), a.class(), a.Do, a.Cd)
+}
+
+// class returns the query class of the entry. Peers that do not send the class
+// fall back to the class of the question in the response.
+func (a *AnswerCache) class() uint16 {
+	if a.Class != 0 {
+		return uint16(a.Class)
+	}
+	if len(a.Response.Question) > 0 {
+		return a.Response.Question[0].Qclass
+	}
+	return dns.ClassINET
+}
+
+// toMsg returns a reply to m built from a copy of the cached response.
+// Every TTL is rewritten to the lifetime remaining at now, so the shared
+// response is never modified.
+func (a *AnswerCache) toMsg(m *dns.Msg, now int64) *dns.Msg {
+	ttl := a.TimeToDie - now
+	if ttl < 0 {
+		ttl = 0
+	}
+	if ttl > math.MaxUint32 {
+		ttl = math.MaxUint32
+	}
+
+	return a.reply(m, uint32(ttl))
+}
+
+// reply returns a reply to m built from a copy of the cached response,
+// with every TTL set to ttl.
+func (a *AnswerCache) reply(m *dns.Msg, ttl uint32) *dns.Msg {
+	res := a.Response.Copy()
+	rcode := res.Rcode
+	res.SetReply(m)
+	res.Rcode = rcode
+
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl = ttl
+		}
+	}
+
+	return res
+}
+
 // by https://github.com/coredns/coredns/blob/002b748ccd6b7cc2e3a65f1bd71509f80b95d342/plugin/cache/cache.go#L68-L87
-func (*CacheRepository) key(qname string, m *dns.Msg, t uint16) (bool, uint64) {
+// t is the qtype: the response types CoreDNS does not cache are filtered
+// by WriteMsg before an answer gets here.
+func (*CacheRepository) key(qname string, m *dns.Msg, t, qclass uint16, do, cd bool) (bool, uint64) {
 	// We don't store truncated responses.
 	if m.Truncated {
 		return false, 0
 	}
-	// Nor errors or Meta or Update.
-	if t == uint16(response.OtherError) || t == uint16(response.Meta) || t == uint16(response.Update) {
-		return false, 0
-	}
 
-	return true, hash(qname, t)
+	return true, hash(qname, t, qclass, do, cd)
+}
+
+// requestKey returns the hash identifying the question of state.
+func requestKey(state *request.Request) uint64 {
+	return hash(state.Name(), state.QType(), state.QClass(), state.Do(), state.Req.CheckingDisabled)
 }
 
-func hash(qname string, qtype uint16) uint64 {
+func hash(qname string, qtype, qclass uint16, do, cd bool) uint64 {
 	h := fnv.New64()
-	_, err := h.Write([]byte{byte(qtype >> 8)})
+	var flags byte
+	if do {
+		flags |= 1
+	}
+	if cd {
+		flags |= 2
+	}
+	_, err := h.Write([]byte{flags})
+	if err != nil {
+		return 0
+	}
+	_, err = h.Write([]byte{byte(qclass >> 8), byte(qclass)})
+	if err != nil {
+		return 0
+	}
+	_, err = h.Write([]byte{byte(qtype >> 8)})
 	if err != nil {
 		return 0
 	}
@@ -400,8 +1147,9 @@ func hash(qname string, qtype uint16) uint64 {
 	return h.Sum64()
 }
 
+// Get returns the entry for r. Names are compared case-insensitively.
 func (c *CacheRepository) Get(now int64, r *request.Request) (*AnswerCache, bool) {
-	ok, key := c.key(r.QName(), r.Req, r.QType())
+	ok, key := c.key(r.Name(), r.Req, r.QType(), r.QClass(), r.Do(), r.Req.CheckingDisabled)
 	if !ok {
 		return nil, false
 	}
@@ -420,34 +1168,71 @@ func (c *CacheRepository) Get(now int64, r *request.Request) (*AnswerCache, bool
 
 	expire := now-cn.TimeToDie > 0
 	if expire {
-		c.items.Remove(key)
+		// Expired entries are kept for GetStale while serving stale.
+		if now-cn.TimeToDie > c.stale {
+			c.items.Remove(key)
+		}
 		return nil, false
 	}
 
 	return cn, true
 }
 
+// GetStale returns the entry for r when it expired no more than the stale
+// window of the repository before now.
+func (c *CacheRepository) GetStale(now int64, r *request.Request) (*AnswerCache, bool) {
+	ok, key := c.key(r.Name(), r.Req, r.QType(), r.QClass(), r.Do(), r.Req.CheckingDisabled)
+	if !ok {
+		return nil, false
+	}
+	v, ok := c.items.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	cn, ok := v.(*AnswerCache)
+	if !ok {
+		return nil, false
+	}
+
+	age := now - cn.TimeToDie
+	if age <= 0 || age > c.stale {
+		return nil, false
+	}
+	return cn, true
+}
+
+// Set stores a copy of msg, so the caller may keep using msg and the stored
+// response is never modified after insertion.
 func (c *CacheRepository) Set(msg *AnswerCache) error {
 	qtype := msg.Type
-	name := msg.Name
+	name := strings.ToLower(msg.Name)
 
-	newExtra := make([]dns.RR, len(msg.Response.Extra))
+	ok, key := c.key(name, msg.Response, uint16(qtype), msg.class(), msg.Do, msg.Cd)
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	entry := *msg
+	entry.Response = msg.Response.Copy()
+	entry.stored = now.Unix()
+	entry.freq = freq.New(now)
+	entry.prefetching = 0
+
+	newExtra := make([]dns.RR, len(entry.Response.Extra))
 
 	j := 0
-	for _, e := range msg.Response.Extra {
+	for _, e := range entry.Response.Extra {
 		if e.Header().Rrtype == dns.TypeOPT {
 			continue
 		}
 		newExtra[j] = e
 		j++
 	}
-	msg.Response.Extra = newExtra[:j]
+	entry.Response.Extra = newExtra[:j]
 
-	ok, key := c.key(name, msg.Response, uint16(qtype))
-	if !ok {
-		return nil
-	}
-	_ = c.items.Add(key, msg)
+	_ = c.items.Add(key, &entry)
 	return nil
 }
 
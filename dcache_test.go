@@ -5,11 +5,20 @@ package dcache
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/response"
 	"github.com/coredns/coredns/plugin/test"
 	"github.com/coredns/coredns/request"
 
@@ -177,6 +186,7 @@ func cacheMsg(m *dns.Msg, tc cacheTestCase) *dns.Msg {
 
 func newTestCache() (*Dcache, dns.ResponseWriter) {
 	c := New("127.0.0.1:6379")
+	c.TransportType = transportMemory
 	log := clog.P{}
 
 	return c, &ResponseWriter{
@@ -186,13 +196,32 @@ func newTestCache() (*Dcache, dns.ResponseWriter) {
 	}
 }
 
+// seedEntry caches the answer of cacheTestCases[1] in the successCache of c
+// under name until timeToDie. It returns the cached response, and a query for
+// name with a recorder for the reply.
+func seedEntry(t testing.TB, c *Dcache, name string, timeToDie int64) (*dns.Msg, *dns.Msg, *dnstest.Recorder) {
+	tc := cacheTestCases[1]
+	m := cacheMsg(tc.in.Msg(), tc)
+	if err := c.successCache.Set(&AnswerCache{
+		Name:      name,
+		Response:  m,
+		Type:      dns.Type(dns.TypeA),
+		TimeToDie: timeToDie,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	return m, req, dnstest.NewRecorder(&test.ResponseWriter{})
+}
+
 func TestCache(t *testing.T) {
 	c, crr := newTestCache()
-	if err := c.connect(); err != nil {
+	if err := c.startup(); err != nil {
 		t.Fatalf("failed connect %s", err)
 	}
-	go c.runSubscribe()
-	go c.runPublish()
+	defer c.shutdown()
 
 	time.Sleep(time.Second)
 
@@ -210,7 +239,7 @@ func TestCache(t *testing.T) {
 			TimeToDie: time.Now().UTC().Add(1 * time.Minute).Unix(),
 			// By is not set use self cache
 		}
-		c.queue.Enqueue(ans)
+		c.enqueue(ans)
 
 		time.Sleep(2 * time.Second)
 		res, eok := c.errorCache.Get(time.Now().UTC().Unix(), state)
@@ -244,45 +273,50 @@ func TestCache(t *testing.T) {
 	}
 }
 
-func BenchmarkCacheResponse(b *testing.B) {
-	c := New("127.0.0.1:6379")
+// newBenchCache starts a node on transport connected to addr, and returns it
+// with the queries of the benchmarks and the answers to them.
+func newBenchCache(b *testing.B, addr, transport string) (*Dcache, []*dns.Msg, []*AnswerCache) {
+	c := New(addr)
+	c.TransportType = transport
 	c.log = clog.NewWithPlugin("test")
-	ctx := context.TODO()
 
-	if err := c.connect(); err != nil {
-		panic(err)
+	if err := c.startup(); err != nil {
+		b.Fatal(err)
 	}
 
-	go c.runSubscribe()
-	go c.runPublish()
-	time.Sleep(5 * time.Second)
-
-	reqs := make([]*dns.Msg, 5)
-	for i, q := range []string{"example1", "example2", "a", "b", "ddd"} {
+	qnames := []string{"example1", "example2", "a", "b", "ddd"}
+	reqs := make([]*dns.Msg, len(qnames))
+	answers := make([]*AnswerCache, len(qnames))
+	for i, q := range qnames {
 		qname := q + ".example.org."
 		reqs[i] = new(dns.Msg)
 		reqs[i].SetQuestion(qname, dns.TypeA)
-		reqs[i].Question[0].Name = qname
-		reqs[i].Question[0].Qtype = dns.TypeA
 
 		resp := &dns.Msg{}
+		resp.SetQuestion(qname, dns.TypeA)
 		resp.Answer = []dns.RR{
 			test.A(qname + "	3600	IN	A	104.21.15.181"),
 			test.A(qname + "	3600	IN	A	195.201.182.103"),
 		}
 
-		now := time.Now()
-
-		c.publish(&AnswerCache{
+		answers[i] = &AnswerCache{
 			Name:      qname,
 			Response:  resp,
 			Type:      dns.Type(dns.TypeA),
-			Do:        false,
-			TimeToDie: now.Unix() + int64(c.minTTL(resp)),
+			TimeToDie: time.Now().Unix() + int64(c.minTTL(resp)),
 			By:        "a",
-			Error:     false,
-		})
+		}
 	}
+	return c, reqs, answers
+}
+
+func BenchmarkCacheResponse(b *testing.B) {
+	c, reqs, answers := newBenchCache(b, "127.0.0.1:6379", transportMemory)
+	defer c.shutdown()
+	ctx := context.TODO()
+	time.Sleep(5 * time.Second)
+
+	c.publish(ctx, answers...)
 
 	time.Sleep(10 * time.Second)
 	b.ResetTimer()
@@ -293,3 +327,511 @@ func BenchmarkCacheResponse(b *testing.B) {
 		}
 	}
 }
+
+func TestWriteThrough(t *testing.T) {
+	c, _ := newTestCache()
+
+	for _, tc := range []struct {
+		m     *dns.Msg
+		error bool
+	}{
+		{m: cacheMsg(cacheTestCases[1].in.Msg(), cacheTestCases[1]), error: false},
+		{m: cacheMsg(cacheTestCases[3].in.Msg(), cacheTestCases[3]), error: true},
+	} {
+		state := &request.Request{W: &test.ResponseWriter{}, Req: tc.m}
+		rw := NewResponsePrinter(&test.ResponseWriter{}, clog.P{}, c, *state)
+		if err := rw.WriteMsg(tc.m); err != nil {
+			t.Fatalf("failed write %s", err)
+		}
+
+		_, eok := c.errorCache.Get(time.Now().UTC().Unix(), state)
+		_, sok := c.successCache.Get(time.Now().UTC().Unix(), state)
+		if eok != tc.error || sok == tc.error {
+			t.Errorf("Local cache of %s type: %s got err %t success %t", state.Name(), state.Type(), eok, sok)
+		}
+	}
+
+	if c.queue.len() != 2 {
+		t.Errorf("Expected 2 answers queued for publishing, got %d", c.queue.len())
+	}
+}
+
+func TestTTL(t *testing.T) {
+	soa := test.SOA("example.org.	3600	IN	SOA	ns.example.org. admin.example.org. 1 7200 3600 1209600 300")
+	longSOA := test.SOA("example.org.	86400	IN	SOA	ns.example.org. admin.example.org. 1 7200 3600 1209600 86400")
+
+	tests := []struct {
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+		minTTL time.Duration
+		maxTTL time.Duration
+		ttl    time.Duration
+	}{
+		{dns.RcodeSuccess, []dns.RR{test.A("example.org.	600	IN	A	127.0.0.1")}, nil, 0, 0, 600 * time.Second},
+		// NXDOMAIN and NODATA live for the SOA MINIMUM when it is below the SOA TTL.
+		{dns.RcodeNameError, nil, []dns.RR{soa}, 0, 0, 300 * time.Second},
+		{dns.RcodeSuccess, nil, []dns.RR{soa}, 0, 0, 300 * time.Second},
+		{dns.RcodeNameError, nil, []dns.RR{test.SOA("example.org.	60	IN	SOA	ns.example.org. admin.example.org. 1 7200 3600 1209600 300")}, 0, 0, 60 * time.Second},
+		// The error cache bounds apply after min_ttl and max_ttl.
+		{dns.RcodeNameError, nil, []dns.RR{longSOA}, 0, 0, defaultErrorMaxTTL},
+		{dns.RcodeNameError, nil, []dns.RR{longSOA}, 0, time.Hour, defaultErrorMaxTTL},
+		{dns.RcodeNameError, nil, []dns.RR{soa}, 0, time.Minute, time.Minute},
+		{dns.RcodeNameError, nil, []dns.RR{test.SOA("example.org.	0	IN	SOA	ns.example.org. admin.example.org. 1 7200 3600 1209600 0")}, 0, 0, defaultErrorMinTTL},
+		// SERVFAIL has no SOA and lives for the error cache minimum.
+		{dns.RcodeServerFailure, nil, nil, 0, 0, defaultErrorMinTTL},
+		// A delegation lives for the TTL of its authority section.
+		{dns.RcodeSuccess, nil, []dns.RR{test.NS("example.org.	900	IN	NS	ns1.example.org."), test.NS("example.org.	600	IN	NS	ns2.example.org.")}, 0, 0, 600 * time.Second},
+		// An empty NOERROR without an SOA lives for the error cache minimum.
+		{dns.RcodeSuccess, nil, nil, 0, 0, defaultErrorMinTTL},
+	}
+
+	for i, tc := range tests {
+		c, _ := newTestCache()
+		c.MinTTL = tc.minTTL
+		c.MaxTTL = tc.maxTTL
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		m.Rcode = tc.rcode
+		m.Answer = tc.answer
+		m.Ns = tc.ns
+		mt, _ := response.Typify(m, time.Now().UTC())
+
+		if ttl := c.ttl(m, mt); ttl != tc.ttl {
+			t.Errorf("Test %d: expected ttl %s for %s, got %s", i, tc.ttl, mt, ttl)
+		}
+	}
+}
+
+func TestStoreErrorMaxTTL(t *testing.T) {
+	c, _ := newTestCache()
+
+	// A peer caching the negative answer without a bound.
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	ans := &AnswerCache{Name: "example.org.", Type: dns.Type(dns.TypeA), Response: m, Error: true, TimeToDie: math.MaxUint32}
+	if err := c.store(ans); err != nil {
+		t.Fatal(err)
+	}
+
+	state := &request.Request{W: &test.ResponseWriter{}, Req: m}
+	cr, ok := c.errorCache.Get(time.Now().UTC().Unix(), state)
+	if !ok {
+		t.Fatalf("Expected %s in the error cache", state.Name())
+	}
+	if max := time.Now().UTC().Add(defaultErrorMaxTTL).Unix(); cr.TimeToDie > max {
+		t.Errorf("Expected time to die at most %d, got %d", max, cr.TimeToDie)
+	}
+	if ans.TimeToDie != math.MaxUint32 {
+		t.Errorf("Expected the received entry left unchanged, got %d", ans.TimeToDie)
+	}
+}
+
+func TestServeDNSDecrementTTL(t *testing.T) {
+	c, _ := newTestCache()
+	now := time.Now().UTC().Unix()
+	m, req, rec := seedEntry(t, c, "bootjp.me.", now+30)
+	if _, err := c.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Msg == nil || len(rec.Msg.Answer) != 2 {
+		t.Fatalf("Expected 2 answers, got %v", rec.Msg)
+	}
+	if rec.Msg.Id != req.Id {
+		t.Errorf("Expected id %d, got %d", req.Id, rec.Msg.Id)
+	}
+	for _, rr := range rec.Msg.Answer {
+		if ttl := rr.Header().Ttl; ttl > 30 || ttl < 28 {
+			t.Errorf("Expected ttl aged to about 30, got %d", ttl)
+		}
+	}
+	for _, rr := range m.Answer {
+		if ttl := rr.Header().Ttl; ttl != 3600 {
+			t.Errorf("Expected cached ttl untouched, got %d", ttl)
+		}
+	}
+
+	ans := &AnswerCache{Response: m, TimeToDie: now - 5}
+	for _, rr := range ans.toMsg(req, now).Answer {
+		if ttl := rr.Header().Ttl; ttl != 0 {
+			t.Errorf("Expected ttl clamped to 0, got %d", ttl)
+		}
+	}
+}
+
+func TestServeDNSConcurrent(t *testing.T) {
+	c, _ := newTestCache()
+	m, _, _ := seedEntry(t, c, "bootjp.me.", time.Now().UTC().Add(time.Minute).Unix())
+	tc := cacheTestCases[1]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				req := new(dns.Msg)
+				req.SetQuestion("bootjp.me.", dns.TypeA)
+				req.Id = id
+				rec := dnstest.NewRecorder(&test.ResponseWriter{})
+				if _, err := c.ServeDNS(context.TODO(), rec, req); err != nil {
+					t.Error(err)
+					return
+				}
+				if rec.Msg == nil || rec.Msg.Id != id {
+					t.Errorf("Expected reply with id %d, got %v", id, rec.Msg)
+					return
+				}
+			}
+		}(uint16(i))
+	}
+
+	// Refresh the entry while it is being served.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			state := &request.Request{W: &test.ResponseWriter{}, Req: m}
+			rw := NewResponsePrinter(&test.ResponseWriter{}, clog.P{}, c, *state)
+			if err := rw.WriteMsg(cacheMsg(tc.in.Msg(), tc)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestCacheKeyFlags(t *testing.T) {
+	c, _ := newTestCache()
+	seedEntry(t, c, "bootjp.me.", time.Now().UTC().Add(time.Minute).Unix())
+
+	for _, tt := range []struct {
+		do, cd bool
+		qclass uint16
+		hit    bool
+	}{
+		{false, false, dns.ClassINET, true},
+		{true, false, dns.ClassINET, false},
+		{false, true, dns.ClassINET, false},
+		{false, false, dns.ClassCHAOS, false},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion("bootjp.me.", dns.TypeA)
+		req.Question[0].Qclass = tt.qclass
+		req.CheckingDisabled = tt.cd
+		if tt.do {
+			req.SetEdns0(4096, true)
+		}
+		state := &request.Request{W: &test.ResponseWriter{}, Req: req}
+		if _, ok := c.successCache.Get(time.Now().UTC().Unix(), state); ok != tt.hit {
+			t.Errorf("Expected hit %t for do %t cd %t class %d, got %t", tt.hit, tt.do, tt.cd, tt.qclass, ok)
+		}
+	}
+}
+
+func TestCacheQtypes(t *testing.T) {
+	// The qtypes of CNAME, SOA and MB are the values of response types
+	// CoreDNS does not cache, which must not keep them out of the cache.
+	for _, tt := range []struct {
+		qtype uint16
+		rr    string
+	}{
+		{dns.TypeCNAME, "bootjp.me.	300	IN	CNAME	example.org."},
+		{dns.TypeSOA, "bootjp.me.	300	IN	SOA	ns.bootjp.me. hostmaster.bootjp.me. 1 7200 3600 1209600 300"},
+		{dns.TypeMB, "bootjp.me.	300	IN	MB	mail.bootjp.me."},
+	} {
+		rr, err := dns.NewRR(tt.rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resolved int32
+		c, _ := newTestCache()
+		c.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			atomic.AddInt32(&resolved, 1)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = []dns.RR{rr}
+			_ = w.WriteMsg(m)
+			return dns.RcodeSuccess, nil
+		})
+
+		for i := 0; i < 2; i++ {
+			req := new(dns.Msg)
+			req.SetQuestion("bootjp.me.", tt.qtype)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := c.ServeDNS(context.TODO(), rec, req); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+				t.Fatalf("Expected an answer for %s, got %v", dns.TypeToString[tt.qtype], rec.Msg)
+			}
+		}
+		if n := atomic.LoadInt32(&resolved); n != 1 {
+			t.Errorf("Expected %s cached after 1 resolution, got %d", dns.TypeToString[tt.qtype], n)
+		}
+	}
+}
+
+func TestCacheCaseInsensitive(t *testing.T) {
+	c, _ := newTestCache()
+	_, req, rec := seedEntry(t, c, "BootJP.me.", time.Now().UTC().Add(time.Minute).Unix())
+	req.SetQuestion("bOOTjp.ME.", dns.TypeA)
+	if _, err := c.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Msg == nil || len(rec.Msg.Answer) != 2 {
+		t.Fatalf("Expected cache hit, got %v", rec.Msg)
+	}
+	if q := rec.Msg.Question[0].Name; q != "bOOTjp.ME." {
+		t.Errorf("Expected question to keep client casing, got %s", q)
+	}
+}
+
+func TestTransportShare(t *testing.T) {
+	bus := NewMemoryBus()
+	a, _ := newTestCache()
+	a.Transport = NewMemoryTransport(bus)
+	b, _ := newTestCache()
+	b.Transport = NewMemoryTransport(bus)
+	defer a.Transport.Close()
+	defer b.Transport.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.runPublish(ctx)
+	go b.runSubscribe(ctx, b.Transport.Subscribe(ctx))
+
+	tc := cacheTestCases[1]
+	m := cacheMsg(tc.in.Msg(), tc)
+	state := &request.Request{W: &test.ResponseWriter{}, Req: m}
+	rw := NewResponsePrinter(&test.ResponseWriter{}, clog.P{}, a, *state)
+	if err := rw.WriteMsg(m); err != nil {
+		t.Fatalf("failed write %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := b.successCache.Get(time.Now().UTC().Unix(), state); ok {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("Expected %s shared with the other node", state.Name())
+}
+
+func TestPublishWithoutPolling(t *testing.T) {
+	bus := NewMemoryBus()
+	c, _ := newTestCache()
+	c.Transport = NewMemoryTransport(bus)
+	defer c.Transport.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := NewMemoryTransport(bus).Subscribe(ctx)
+	for i := 0; i < c.Workers; i++ {
+		go c.runPublish(ctx)
+	}
+	// Let the workers go idle, so the entry is published on notification.
+	time.Sleep(50 * time.Millisecond)
+
+	for _, qname := range []string{"a.example.org.", "b.example.org."} {
+		c.enqueue(testAnswer(qname))
+		select {
+		case ans := <-sub:
+			if ans.Name != qname {
+				t.Errorf("Expected %s, got %s", qname, ans.Name)
+			}
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("Expected %s published without waiting for a poll interval", qname)
+		}
+	}
+}
+
+func TestCollectBatch(t *testing.T) {
+	c, _ := newTestCache()
+	c.BatchSize = 3
+	c.BatchWindow = 50 * time.Millisecond
+	ctx := context.Background()
+
+	for _, n := range []string{"a.", "b.", "c.", "d."} {
+		c.enqueue(testAnswer(n))
+	}
+	start := time.Now()
+	if batch := c.collect(ctx); len(batch) != 3 {
+		t.Errorf("Expected a full batch of 3, got %d", len(batch))
+	}
+	if time.Since(start) >= c.BatchWindow {
+		t.Errorf("Expected a full batch without waiting for the window")
+	}
+
+	start = time.Now()
+	if batch := c.collect(ctx); len(batch) != 1 {
+		t.Errorf("Expected the remaining entry, got %d", len(batch))
+	}
+	if time.Since(start) < c.BatchWindow {
+		t.Errorf("Expected a partial batch after the window")
+	}
+}
+
+func BenchmarkPublish(b *testing.B) {
+	s, err := miniredis.Run()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	c, _, answers := newBenchCache(b, s.Addr(), transportRedis)
+	defer c.shutdown()
+	ctx := context.TODO()
+
+	for _, size := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("batch-%d", size), func(b *testing.B) {
+			batch := make([]*AnswerCache, size)
+			for i := range batch {
+				batch[i] = answers[i%len(answers)]
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i += size {
+				c.publish(ctx, batch...)
+			}
+		})
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	servfail := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		_ = w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+	answer := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{test.A("bootjp.me.	300	IN	A	192.0.2.1")}
+		_ = w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+	timeout := test.NextHandler(dns.RcodeServerFailure, errors.New("i/o timeout"))
+
+	tests := []struct {
+		next       plugin.Handler
+		serveStale time.Duration
+		expired    int64
+		rcode      int
+		ttl        uint32
+	}{
+		{servfail, time.Hour, 60, dns.RcodeSuccess, staleTTL},
+		{timeout, time.Hour, 60, dns.RcodeSuccess, staleTTL},
+		// The upstream answers, so the fresh answer is served.
+		{answer, time.Hour, 60, dns.RcodeSuccess, 300},
+		// Expired for longer than the stale window.
+		{servfail, time.Minute, 120, dns.RcodeServerFailure, 0},
+		{servfail, 0, 60, dns.RcodeServerFailure, 0},
+	}
+
+	for i, tc := range tests {
+		c, _ := newTestCache()
+		c.ServeStale = tc.serveStale
+		c.successCache.stale = int64(tc.serveStale / time.Second)
+		c.errorCache.stale = int64(tc.serveStale / time.Second)
+		c.Next = tc.next
+
+		_, req, rec := seedEntry(t, c, "bootjp.me.", time.Now().Unix()-tc.expired)
+		rcode, _ := c.ServeDNS(context.TODO(), rec, req)
+
+		if tc.ttl == 0 {
+			if rec.Msg != nil && len(rec.Msg.Answer) > 0 {
+				t.Errorf("Test %d: expected no stale answer, got %v", i, rec.Msg)
+			}
+			if rcode != tc.rcode && (rec.Msg == nil || rec.Msg.Rcode != tc.rcode) {
+				t.Errorf("Test %d: expected rcode %d, got %d %v", i, tc.rcode, rcode, rec.Msg)
+			}
+			continue
+		}
+		if rcode != tc.rcode || rec.Msg == nil || len(rec.Msg.Answer) == 0 {
+			t.Fatalf("Test %d: expected an answer, got rcode %d %v", i, rcode, rec.Msg)
+		}
+		if ttl := rec.Msg.Answer[0].Header().Ttl; ttl != tc.ttl {
+			t.Errorf("Test %d: expected ttl %d, got %d", i, tc.ttl, ttl)
+		}
+	}
+}
+
+func TestServeStaleCachedFailure(t *testing.T) {
+	c, _ := newTestCache()
+	c.ServeStale = time.Hour
+	c.successCache.stale = 3600
+	c.errorCache.stale = 3600
+	c.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+	now := time.Now().Unix()
+	_, req, rec := seedEntry(t, c, "bootjp.me.", now-60)
+
+	// A peer shared the SERVFAIL of its upstream.
+	fail := new(dns.Msg)
+	fail.SetRcode(req, dns.RcodeServerFailure)
+	_ = c.errorCache.Set(&AnswerCache{Name: "bootjp.me.", Response: fail, Type: dns.Type(dns.TypeA), TimeToDie: now + 60, Error: true})
+
+	if _, err := c.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) == 0 {
+		t.Fatalf("Expected the stale answer instead of the cached SERVFAIL, got %v", rec.Msg)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	var resolved int32
+	c, _ := newTestCache()
+	c.Prefetch = 2
+	c.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		atomic.AddInt32(&resolved, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{test.A("bootjp.me.	300	IN	A	192.0.2.1")}
+		_ = w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+
+	// The entry has 1 second of its lifetime left, within 10% of it.
+	_, req, _ := seedEntry(t, c, "bootjp.me.", time.Now().Unix()+1)
+
+	for i := 0; i < 4; i++ {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := c.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Msg == nil || len(rec.Msg.Answer) == 0 {
+			t.Fatalf("Query %d: expected a cached answer, got %v", i, rec.Msg)
+		}
+		if i == 0 {
+			time.Sleep(50 * time.Millisecond)
+			if n := atomic.LoadInt32(&resolved); n != 0 {
+				t.Fatalf("Expected no prefetch before the entry is popular, got %d", n)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		state := &request.Request{W: &test.ResponseWriter{}, Req: req}
+		if cr, ok := c.successCache.Get(time.Now().Unix(), state); ok && cr.TimeToDie > time.Now().Unix()+60 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&resolved); n != 1 {
+		t.Errorf("Expected 1 prefetch, got %d", n)
+	}
+	// The renewed entry is published to the cluster.
+	if n := c.queue.len(); n != 1 {
+		t.Errorf("Expected the renewed entry queued for publishing, got %d", n)
+	}
+}
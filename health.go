@@ -0,0 +1,151 @@
+package dcache
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// ConnState is the state of the connection of a node to Redis.
+type ConnState int32
+
+const (
+	// StateConnecting is the state until Redis is reached for the first time.
+	StateConnecting ConnState = iota
+	// StateUp is the state while every routine talks to Redis successfully.
+	StateUp
+	// StateDegraded is the state while a routine fails to talk to Redis.
+	// The node keeps serving from its local cache.
+	StateDegraded
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateUp:
+		return "up"
+	case StateDegraded:
+		return "degraded"
+	}
+	return "unknown"
+}
+
+// The routines reporting to Health.
+const (
+	routineConnect   = "connect"
+	routineSubscribe = "subscribe"
+	routinePublish   = "publish"
+)
+
+// Health tracks the state of the connection to Redis from the results reported
+// by the routines of a node, and exports it as a gauge.
+type Health struct {
+	log     clog.P
+	state   int32
+	mu      sync.Mutex
+	failing map[string]bool
+}
+
+// NewHealth returns a Health in StateConnecting.
+func NewHealth(log clog.P) *Health {
+	return &Health{
+		log:     log,
+		state:   int32(StateConnecting),
+		failing: make(map[string]bool),
+	}
+}
+
+// State returns the current state.
+func (h *Health) State() ConnState {
+	return ConnState(atomic.LoadInt32(&h.state))
+}
+
+// Report records the result of the last Redis operation of routine.
+// Reports to a nil Health are ignored.
+func (h *Health) Report(ctx context.Context, routine string, err error) {
+	if h == nil {
+		return
+	}
+	if err == nil && h.State() == StateUp {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err != nil {
+		h.failing[routine] = true
+	} else {
+		delete(h.failing, routine)
+	}
+
+	s := h.State()
+	switch {
+	case len(h.failing) == 0:
+		s = StateUp
+	case s == StateUp:
+		s = StateDegraded
+	}
+	h.set(ctx, s)
+}
+
+// set moves to state s. The caller holds h.mu.
+func (h *Health) set(ctx context.Context, s ConnState) {
+	connectionState.WithLabelValues(metrics.WithServer(ctx)).Set(float64(s))
+	if old := ConnState(atomic.SwapInt32(&h.state, int32(s))); old == s {
+		return
+	}
+
+	if s == StateDegraded {
+		h.log.Warningf("transport is %s, serving from the local cache", s)
+		return
+	}
+	h.log.Infof("transport is %s", s)
+}
+
+// retryBackoff bounds the delays between retries after a Redis error.
+var retryBackoff = backoff{min: 500 * time.Millisecond, max: 30 * time.Second}
+
+// backoff returns jittered, exponentially growing delays between retries.
+type backoff struct {
+	min, max time.Duration
+	n        int
+}
+
+// next returns the delay before the next retry: min doubled for every retry
+// since the last reset, capped at max, with up to half of it taken off at random
+// so that nodes disconnected together do not retry together.
+func (b *backoff) next() time.Duration {
+	d := b.min
+	for i := 0; i < b.n && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	b.n++
+	return d - time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// reset starts the delays over from min.
+func (b *backoff) reset() {
+	b.n = 0
+}
+
+// sleep waits for d, and reports false when ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
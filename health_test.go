@@ -0,0 +1,112 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+func TestHealth(t *testing.T) {
+	errDown := errors.New("connection refused")
+
+	tests := []struct {
+		routine string
+		err     error
+		state   ConnState
+	}{
+		// Failures before Redis was ever reached keep connecting.
+		{routineConnect, errDown, StateConnecting},
+		{routineConnect, nil, StateUp},
+		{routineSubscribe, nil, StateUp},
+		{routineSubscribe, errDown, StateDegraded},
+		{routinePublish, errDown, StateDegraded},
+		// Up only when every failing routine recovered.
+		{routineSubscribe, nil, StateDegraded},
+		{routinePublish, nil, StateUp},
+	}
+
+	h := NewHealth(clog.P{})
+	if h.State() != StateConnecting {
+		t.Fatalf("Expected %s, got %s", StateConnecting, h.State())
+	}
+	for i, tc := range tests {
+		h.Report(context.Background(), tc.routine, tc.err)
+		if h.State() != tc.state {
+			t.Errorf("Test %d: expected %s after %s reported %v, got %s", i, tc.state, tc.routine, tc.err, h.State())
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: 100 * time.Millisecond, max: time.Second}
+
+	for i, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		if d := b.next(); d < max/2 || d > max {
+			t.Errorf("Retry %d: expected a delay between %s and %s, got %s", i, max/2, max, d)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d > 100*time.Millisecond {
+		t.Errorf("Expected a delay of at most %s after reset, got %s", b.min, d)
+	}
+}
+
+func TestStartupContinue(t *testing.T) {
+	defer func(b backoff) { retryBackoff = b }(retryBackoff)
+	retryBackoff = backoff{min: 10 * time.Millisecond, max: 50 * time.Millisecond}
+
+	// Reserve an address nothing listens on yet.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	d := New(addr)
+	if err := d.startup(); err == nil {
+		t.Fatalf("Expected startup to fail without Redis")
+	}
+
+	d = New(addr)
+	d.Startup = startupContinue
+	if err := d.startup(); err != nil {
+		t.Fatalf("Expected startup to continue without Redis, got %s", err)
+	}
+	defer d.shutdown()
+	if d.health.State() != StateConnecting {
+		t.Errorf("Expected %s, got %s", StateConnecting, d.health.State())
+	}
+
+	s := miniredis.NewMiniRedis()
+	if err := s.StartAddr(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	waitState(t, d.health, StateUp)
+
+	s.Close()
+	waitState(t, d.health, StateDegraded)
+
+	if err := s.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, d.health, StateUp)
+}
+
+func waitState(t *testing.T, h *Health, state ConnState) {
+	deadline := time.Now().Add(5 * time.Second)
+	for h.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s, got %s", state, h.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
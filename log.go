@@ -0,0 +1,40 @@
+package dcache
+
+import (
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// logLimiter writes at most one message per interval and reports how many it suppressed.
+type logLimiter struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	last       time.Time
+	suppressed int
+}
+
+func newLogLimiter(interval time.Duration) *logLimiter {
+	return &logLimiter{interval: interval}
+}
+
+// Warningf logs like clog.P.Warningf unless a message was logged within the interval.
+func (l *logLimiter) Warningf(log clog.P, format string, v ...interface{}) {
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.last) < l.interval {
+		l.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	suppressed := l.suppressed
+	l.last = now
+	l.suppressed = 0
+	l.mu.Unlock()
+
+	if suppressed > 0 {
+		log.Warningf("%d similar messages suppressed", suppressed)
+	}
+	log.Warningf(format, v...)
+}
@@ -0,0 +1,105 @@
+package dcache
+
+import (
+	"context"
+	"sync"
+)
+
+// memorySubscriberBuffer is the number of entries buffered per subscriber.
+// Entries are dropped for subscribers that fall further behind, as Redis Pub/Sub does.
+const memorySubscriberBuffer = 1024
+
+// MemoryBus connects the MemoryTransports of a single process.
+type MemoryBus struct {
+	mu   sync.Mutex
+	subs map[chan *AnswerCache]struct{}
+}
+
+// NewMemoryBus returns an empty MemoryBus.
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		subs: map[chan *AnswerCache]struct{}{},
+	}
+}
+
+// memoryBus is shared by every dcache configured with the memory transport.
+var memoryBus = NewMemoryBus()
+
+func (b *MemoryBus) broadcast(ans *AnswerCache) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		c := *ans
+		c.Response = ans.Response.Copy()
+		select {
+		case ch <- &c:
+		default:
+		}
+	}
+}
+
+func (b *MemoryBus) add(ch chan *AnswerCache) {
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+}
+
+func (b *MemoryBus) remove(ch chan *AnswerCache) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+// MemoryTransport is a Transport that delivers entries in-process through a MemoryBus.
+// It lets dcache run without a Redis server.
+type MemoryTransport struct {
+	bus  *MemoryBus
+	once sync.Once
+	done chan struct{}
+}
+
+// NewMemoryTransport returns a MemoryTransport attached to bus.
+func NewMemoryTransport(bus *MemoryBus) *MemoryTransport {
+	return &MemoryTransport{
+		bus:  bus,
+		done: make(chan struct{}),
+	}
+}
+
+// Publish implements the Transport interface.
+func (t *MemoryTransport) Publish(ctx context.Context, ans *AnswerCache) error {
+	select {
+	case <-t.done:
+		return errTransportClosed
+	default:
+	}
+
+	t.bus.broadcast(ans)
+	return nil
+}
+
+// Subscribe implements the Transport interface.
+func (t *MemoryTransport) Subscribe(ctx context.Context) <-chan *AnswerCache {
+	ch := make(chan *AnswerCache, memorySubscriberBuffer)
+	t.bus.add(ch)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-t.done:
+		}
+		t.bus.remove(ch)
+		close(ch)
+	}()
+
+	return ch
+}
+
+// Close implements the Transport interface.
+func (t *MemoryTransport) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+	})
+	return nil
+}
@@ -29,6 +29,90 @@ var (
 		Help:      "The count of cache discard data of corrupted.",
 	}, []string{"server"})
 
+	prefetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "prefetch_total",
+		Help:      "The count of popular entries resolved again before they expire.",
+	}, []string{"server"})
+
+	servedStale = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "served_stale_total",
+		Help:      "The count of expired entries served because the next plugin failed.",
+	}, []string{"server"})
+
+	lookupHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "lookup_hits_total",
+		Help:      "The count of misses answered from the snapshot in Redis.",
+	}, []string{"server"})
+
+	lookupErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "lookup_errors_total",
+		Help:      "The count of snapshot lookups that failed or ran out of time.",
+	}, []string{"server"})
+
+	coalesced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "coalesced_total",
+		Help:      "The count of misses answered by a resolution in flight on this node or a peer.",
+	}, []string{"server"})
+
+	publishQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "publish_queue_depth",
+		Help:      "The number of entries waiting to be published.",
+	}, []string{"server"})
+
+	publishDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "publish_dropped_total",
+		Help:      "The count of entries dropped because the publish queue was full.",
+	}, []string{"server"})
+
+	schemaRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "schema_rejected_total",
+		Help:      "The count of received entries rejected for an unknown schema version or missing fields.",
+	}, []string{"server"})
+
+	signatureRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "signature_rejected_total",
+		Help:      "The count of received entries rejected for a missing or invalid HMAC signature.",
+	}, []string{"server"})
+
+	validationRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "validation_rejected_total",
+		Help:      "The count of received entries rejected because the response does not answer their question.",
+	}, []string{"server"})
+
+	encodeErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "encode_errors_total",
+		Help:      "The count of entries left out of a publish because they could not be encoded.",
+	}, []string{"server"})
+
+	connectionState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "connection_state",
+		Help:      "The state of the connection to Redis: 0 connecting, 1 up, 2 degraded.",
+	}, []string{"server"})
+
 	redisErr = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: name,
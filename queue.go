@@ -0,0 +1,101 @@
+package dcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Policies applied by publishQueue when it is full.
+const (
+	// dropNewest discards the entry being queued.
+	dropNewest = "drop_newest"
+	// dropOldest discards the entry queued first to make room.
+	dropOldest = "drop_oldest"
+	// coalesce replaces a queued entry for the same key, and otherwise discards the entry being queued.
+	coalesce = "coalesce"
+)
+
+// publishQueue is a bounded FIFO of entries waiting to be published.
+type publishQueue struct {
+	mu    sync.Mutex
+	items *list.List
+	keys  map[uint64]*list.Element
+	// ready is signaled when entries are queued.
+	ready chan struct{}
+}
+
+func newPublishQueue() *publishQueue {
+	return &publishQueue{
+		items: list.New(),
+		keys:  map[uint64]*list.Element{},
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *publishQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// push queues ans. When the queue holds limit entries, policy decides which
+// entry is discarded. It returns the number of entries discarded.
+// A limit of zero or less means no limit.
+func (q *publishQueue) push(ans *AnswerCache, limit int, policy string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := ans.key()
+	if policy == coalesce {
+		if e, ok := q.keys[key]; ok {
+			e.Value = ans
+			return 0
+		}
+	}
+
+	dropped := 0
+	if limit > 0 && q.items.Len() >= limit {
+		if policy != dropOldest {
+			return 1
+		}
+		q.remove(q.items.Front())
+		dropped++
+	}
+
+	q.keys[key] = q.items.PushBack(ans)
+	q.notify()
+	return dropped
+}
+
+// pop removes and returns the entry queued first, or nil when the queue is empty.
+func (q *publishQueue) pop() *AnswerCache {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	e := q.items.Front()
+	if e == nil {
+		return nil
+	}
+	q.remove(e)
+	// Wake another worker while entries are left.
+	if q.items.Len() > 0 {
+		q.notify()
+	}
+	return e.Value.(*AnswerCache)
+}
+
+func (q *publishQueue) remove(e *list.Element) {
+	ans := q.items.Remove(e).(*AnswerCache)
+	if q.keys[ans.key()] == e {
+		delete(q.keys, ans.key())
+	}
+}
+
+// len returns the number of queued entries.
+func (q *publishQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.items.Len()
+}
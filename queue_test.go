@@ -0,0 +1,57 @@
+package dcache
+
+import (
+	"testing"
+)
+
+func TestPublishQueue(t *testing.T) {
+	tests := []struct {
+		policy  string
+		push    []string
+		dropped int
+		want    []string
+	}{
+		{dropNewest, []string{"a.", "b.", "c."}, 1, []string{"a.", "b."}},
+		{dropOldest, []string{"a.", "b.", "c."}, 1, []string{"b.", "c."}},
+		{coalesce, []string{"a.", "b.", "a."}, 0, []string{"a.", "b."}},
+		{coalesce, []string{"a.", "b.", "c."}, 1, []string{"a.", "b."}},
+		{dropNewest, []string{"a.", "a."}, 0, []string{"a.", "a."}},
+	}
+
+	for i, tc := range tests {
+		q := newPublishQueue()
+		dropped := 0
+		for j, n := range tc.push {
+			ans := testAnswer(n)
+			ans.TimeToDie = int64(j)
+			dropped += q.push(ans, 2, tc.policy)
+		}
+
+		if dropped != tc.dropped {
+			t.Errorf("Test %d: expected %d dropped, got %d", i, tc.dropped, dropped)
+		}
+		if q.len() != len(tc.want) {
+			t.Errorf("Test %d: expected %d queued, got %d", i, len(tc.want), q.len())
+		}
+
+		for _, want := range tc.want {
+			ans := q.pop()
+			if ans == nil || ans.Name != want {
+				t.Errorf("Test %d: expected %s, got %v", i, want, ans)
+			}
+		}
+		if q.pop() != nil {
+			t.Errorf("Test %d: expected empty queue", i)
+		}
+	}
+
+	// Coalescing keeps the position of the first entry and the value of the latest.
+	q := newPublishQueue()
+	q.push(testAnswer("a."), 2, coalesce)
+	latest := testAnswer("a.")
+	latest.TimeToDie = 42
+	q.push(latest, 2, coalesce)
+	if ans := q.pop(); ans != latest {
+		t.Errorf("Expected coalesced entry to be the latest one, got %v", ans)
+	}
+}
@@ -0,0 +1,263 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/redis/go-redis/v9"
+)
+
+// subscribeTimeout bounds the wait for Redis to confirm a subscription.
+const subscribeTimeout = 5 * time.Second
+
+var errShardMoved = errors.New("channel moved to another shard")
+
+// RedisOptions describes the Redis deployment to connect to: a single server,
+// a master monitored by Sentinel when MasterName is set, or a Redis Cluster.
+type RedisOptions struct {
+	redis.UniversalOptions
+	// ClusterMode connects to Addrs as the seed nodes of a Redis Cluster.
+	ClusterMode bool
+}
+
+// newClient returns a client for the deployment with a pool of poolSize connections.
+// A Sentinel client always talks to the current master, so it follows a failover.
+func (o RedisOptions) newClient(poolSize int) redis.UniversalClient {
+	o.PoolSize = poolSize
+	switch {
+	case o.MasterName != "":
+		return redis.NewFailoverClient(o.Failover())
+	case o.ClusterMode:
+		return redis.NewClusterClient(o.Cluster())
+	default:
+		return redis.NewClient(o.Simple())
+	}
+}
+
+// redisConns are the clients of a Redis transport. The publish connection pool
+// is sized by the options, one connection is enough to receive.
+type redisConns struct {
+	subscribeCon redis.UniversalClient
+	publishCon   redis.UniversalClient
+}
+
+// dial connects both clients to the deployment described by o.
+func (o *RedisOptions) dial(log clog.P) (redisConns, error) {
+	ctx := context.Background()
+	c := redisConns{
+		publishCon:   o.newClient(o.PoolSize),
+		subscribeCon: o.newClient(1),
+	}
+
+	for _, con := range []redis.UniversalClient{c.subscribeCon, c.publishCon} {
+		if err := con.Ping(ctx).Err(); err != nil {
+			log.Error("failed connect redis", err)
+			_ = c.Close()
+			return redisConns{}, err
+		}
+	}
+	return c, nil
+}
+
+// Close closes both clients, which implements the Transport interface for the
+// transports embedding redisConns.
+func (c redisConns) Close() error {
+	perr := c.publishCon.Close()
+	serr := c.subscribeCon.Close()
+	if perr != nil {
+		return perr
+	}
+	return serr
+}
+
+// RedisTransport is a Transport on top of Redis Pub/Sub.
+// On a Redis Cluster it uses sharded Pub/Sub, so entries only travel through
+// the shard owning the channel.
+type RedisTransport struct {
+	redisConns
+	log     clog.P
+	channel string
+	codec   *Codec
+	health  *Health
+	sharded bool
+}
+
+// NewRedisTransport connects to the Redis deployment described by opt and
+// shares entries on channel, encoded by codec. The subscriber reports to health.
+func NewRedisTransport(opt *RedisOptions, channel string, codec *Codec, health *Health, log clog.P) (*RedisTransport, error) {
+	conns, err := opt.dial(log)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedisTransport{
+		redisConns: conns,
+		log:        log,
+		channel:    channel,
+		codec:      codec,
+		health:     health,
+		sharded:    opt.ClusterMode,
+	}, nil
+}
+
+// Publish implements the Transport interface.
+func (t *RedisTransport) Publish(ctx context.Context, ans *AnswerCache) error {
+	b, err := t.codec.Encode(ans)
+	if err != nil {
+		return err
+	}
+
+	if t.sharded {
+		return t.publishCon.SPublish(ctx, t.channel, string(b)).Err()
+	}
+	return t.publishCon.Publish(ctx, t.channel, string(b)).Err()
+}
+
+// PublishBatch implements the BatchPublisher interface with a single pipeline.
+// Entries that cannot be encoded are skipped.
+func (t *RedisTransport) PublishBatch(ctx context.Context, ans []*AnswerCache) error {
+	payloads := make([]string, 0, len(ans))
+	for _, a := range ans {
+		b, err := t.codec.Encode(a)
+		if err != nil {
+			skipEntry(ctx, t.log, err)
+			continue
+		}
+		payloads = append(payloads, string(b))
+	}
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	_, err := t.publishCon.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, b := range payloads {
+			if t.sharded {
+				p.SPublish(ctx, t.channel, b)
+				continue
+			}
+			p.Publish(ctx, t.channel, b)
+		}
+		return nil
+	})
+	return err
+}
+
+// Subscribe implements the Transport interface.
+// After an error, or when the slot of a sharded channel moves, it backs off and
+// subscribes again on a new connection.
+func (t *RedisTransport) Subscribe(ctx context.Context) <-chan *AnswerCache {
+	ch := make(chan *AnswerCache)
+
+	sub, err := t.subscribe(ctx)
+
+	go func() {
+		defer close(ch)
+
+		b := retryBackoff
+		for {
+			if err == nil {
+				b.reset()
+				err = t.receive(ctx, sub, ch)
+			}
+			if ctx.Err() != nil || errors.Is(err, redis.ErrClosed) {
+				return
+			}
+			t.log.Errorf("failed receive %s", err)
+			redisErr.WithLabelValues(metrics.WithServer(ctx)).Inc()
+			t.health.Report(ctx, routineSubscribe, err)
+			if cc, ok := t.subscribeCon.(*redis.ClusterClient); ok {
+				// The slot of the channel may have moved to another shard.
+				cc.ReloadState(ctx)
+			}
+
+			if !sleep(ctx, b.next()) {
+				return
+			}
+			sub, err = t.subscribe(ctx)
+		}
+	}()
+
+	return ch
+}
+
+// subscribe subscribes to the channel, with sharded Pub/Sub on a Redis Cluster,
+// and waits up to subscribeTimeout for Redis to confirm it.
+func (t *RedisTransport) subscribe(ctx context.Context) (*redis.PubSub, error) {
+	var sub *redis.PubSub
+	if t.sharded {
+		sub = t.subscribeCon.SSubscribe(ctx, t.channel)
+	} else {
+		sub = t.subscribeCon.Subscribe(ctx, t.channel)
+	}
+
+	msg, err := sub.ReceiveTimeout(ctx, subscribeTimeout)
+	if err == nil {
+		if _, ok := msg.(*redis.Subscription); !ok {
+			err = fmt.Errorf("unexpected reply %v", msg)
+		}
+	}
+	if err != nil {
+		_ = sub.Close()
+		return nil, err
+	}
+
+	t.health.Report(ctx, routineSubscribe, nil)
+	return sub, nil
+}
+
+// receive sends the entries received on sub to ch until ctx is done, an error
+// occurs or the sharded subscription ends. It closes sub.
+func (t *RedisTransport) receive(ctx context.Context, sub *redis.PubSub, ch chan<- *AnswerCache) error {
+	// Receive does not return on ctx cancellation, so closing
+	// the subscription is what ends a blocked receive.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		_ = sub.Close()
+	}()
+
+	for {
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			// Redis ends the sharded subscriptions of a slot moving to another shard.
+			if m.Kind == "sunsubscribe" {
+				return errShardMoved
+			}
+		case *redis.Message:
+			t.log.Debug("receive message", m.String())
+			if !t.deliver(ctx, ch, []byte(m.Payload)) {
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// deliver decodes payload and sends the entry to ch. It reports false when
+// ctx is done first.
+func (t *RedisTransport) deliver(ctx context.Context, ch chan<- *AnswerCache, payload []byte) bool {
+	ans, err := t.codec.Decode(payload)
+	if err != nil {
+		rejectEntry(ctx, t.log, err)
+		return true
+	}
+
+	select {
+	case ch <- ans:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
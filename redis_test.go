@@ -0,0 +1,369 @@
+package dcache
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestSentinel runs a Sentinel stand-in that reports the address stored in master.
+func newTestSentinel(t *testing.T, master *atomic.Value) string {
+	srv, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+
+	_ = srv.Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		if len(args) > 0 && strings.EqualFold(args[0], "get-master-addr-by-name") {
+			host, port, _ := net.SplitHostPort(master.Load().(string))
+			c.WriteStrings([]string{host, port})
+			return
+		}
+		c.WriteLen(0)
+	})
+	_ = srv.Register("SUBSCRIBE", func(c *server.Peer, cmd string, args []string) {
+		for i, ch := range args {
+			c.WriteLen(3)
+			c.WriteBulk("subscribe")
+			c.WriteBulk(ch)
+			c.WriteInt(i + 1)
+		}
+	})
+	_ = srv.Register("PING", func(c *server.Peer, cmd string, args []string) {
+		c.WriteInline("PONG")
+	})
+
+	return srv.Addr().String()
+}
+
+// waitSubscribed waits until s has a subscriber on channel.
+func waitSubscribed(t *testing.T, s *miniredis.Miniredis, channel string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.PubSubNumSub(channel)[channel] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("No subscriber on %s at %s", channel, s.Addr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisSubscribe(t *testing.T) {
+	s := miniredis.RunT(t)
+	opt := &RedisOptions{UniversalOptions: redis.UniversalOptions{Addrs: []string{s.Addr()}}}
+	tr, err := NewRedisTransport(opt, name, &Codec{}, nil, clog.P{})
+	if err != nil {
+		t.Fatalf("failed connect %s", err)
+	}
+	defer tr.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Subscribe returns once subscribed, so an entry published right after it is received.
+	ch := tr.Subscribe(ctx)
+	if n := s.PubSubNumSub(name)[name]; n != 1 {
+		t.Fatalf("Expected a subscriber on %s when Subscribe returned, got %d", name, n)
+	}
+	if err := tr.Publish(ctx, testAnswer("a.example.org.")); err != nil {
+		t.Fatalf("failed publish %s", err)
+	}
+	receive(t, ch, "a.example.org.")
+}
+
+func TestRedisSentinelFailover(t *testing.T) {
+	defer func(b backoff) { retryBackoff = b }(retryBackoff)
+	retryBackoff = backoff{min: 10 * time.Millisecond, max: 10 * time.Millisecond}
+
+	old := miniredis.RunT(t)
+	cur := miniredis.RunT(t)
+	var master atomic.Value
+	master.Store(old.Addr())
+
+	opt := &RedisOptions{UniversalOptions: redis.UniversalOptions{
+		Addrs:      []string{newTestSentinel(t, &master)},
+		MasterName: "mymaster",
+	}}
+	tr, err := NewRedisTransport(opt, name, &Codec{}, nil, clog.P{})
+	if err != nil {
+		t.Fatalf("failed connect %s", err)
+	}
+	defer tr.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := tr.Subscribe(ctx)
+
+	waitSubscribed(t, old, name)
+	if err := tr.Publish(ctx, testAnswer("before.example.org.")); err != nil {
+		t.Fatalf("failed publish %s", err)
+	}
+	receive(t, ch, "before.example.org.")
+
+	// Sentinel promotes cur, and the old master goes away.
+	master.Store(cur.Addr())
+	old.Close()
+
+	waitSubscribed(t, cur, name)
+	if err := tr.Publish(ctx, testAnswer("after.example.org.")); err != nil {
+		t.Fatalf("failed publish after failover %s", err)
+	}
+	receive(t, ch, "after.example.org.")
+}
+
+// withSPublish teaches s SPUBLISH, which miniredis lacks, as a plain PUBLISH.
+func withSPublish(s *miniredis.Miniredis) *miniredis.Miniredis {
+	_ = s.Server().Register("SPUBLISH", func(c *server.Peer, cmd string, args []string) {
+		if len(args) != 2 {
+			c.WriteError("ERR wrong number of arguments")
+			return
+		}
+		c.WriteInt(s.Publish(args[0], args[1]))
+	})
+	return s
+}
+
+// testCluster is a Redis Cluster stand-in with a single slot range, owned by
+// one of its nodes, that only knows sharded Pub/Sub, which miniredis lacks.
+type testCluster struct {
+	t     *testing.T
+	nodes []*server.Server
+	owner int32
+
+	mu   sync.Mutex
+	subs map[int][]*server.Peer
+}
+
+func newTestCluster(t *testing.T, n int) *testCluster {
+	tc := &testCluster{t: t, subs: make(map[int][]*server.Peer)}
+	for i := 0; i < n; i++ {
+		srv, err := server.NewServer("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(srv.Close)
+		tc.nodes = append(tc.nodes, srv)
+	}
+	for i, srv := range tc.nodes {
+		tc.register(i, srv)
+	}
+	return tc
+}
+
+func (tc *testCluster) addrs() []string {
+	var addrs []string
+	for _, srv := range tc.nodes {
+		addrs = append(addrs, srv.Addr().String())
+	}
+	return addrs
+}
+
+// moved replies MOVED from a node not owning the slots, and reports whether it did.
+func (tc *testCluster) moved(i int, c *server.Peer) bool {
+	owner := int(atomic.LoadInt32(&tc.owner))
+	if i == owner {
+		return false
+	}
+	// go-redis follows the address, the slot is not checked.
+	c.WriteError(fmt.Sprintf("MOVED 0 %s", tc.nodes[owner].Addr()))
+	return true
+}
+
+func (tc *testCluster) register(i int, srv *server.Server) {
+	_ = srv.Register("CLUSTER", func(c *server.Peer, cmd string, args []string) {
+		owner := tc.nodes[atomic.LoadInt32(&tc.owner)].Addr()
+		c.Block(func(w *server.Writer) {
+			w.WriteLen(1)
+			w.WriteLen(3)
+			w.WriteInt(0)
+			w.WriteInt(16383)
+			w.WriteLen(3)
+			w.WriteBulk(owner.IP.String())
+			w.WriteInt(owner.Port)
+			w.WriteBulk(fmt.Sprintf("node%d", i))
+		})
+	})
+	_ = srv.Register("PING", func(c *server.Peer, cmd string, args []string) {
+		c.WriteInline("PONG")
+	})
+	_ = srv.Register("SSUBSCRIBE", func(c *server.Peer, cmd string, args []string) {
+		if len(args) != 1 {
+			c.WriteError("ERR wrong number of arguments")
+			return
+		}
+		if tc.moved(i, c) {
+			return
+		}
+		tc.mu.Lock()
+		tc.subs[i] = append(tc.subs[i], c)
+		tc.mu.Unlock()
+		c.OnDisconnect(func() { tc.unsubscribe(i, c) })
+		c.Block(func(w *server.Writer) {
+			w.WriteLen(3)
+			w.WriteBulk("ssubscribe")
+			w.WriteBulk(args[0])
+			w.WriteInt(1)
+		})
+	})
+	_ = srv.Register("SPUBLISH", func(c *server.Peer, cmd string, args []string) {
+		if len(args) != 2 {
+			c.WriteError("ERR wrong number of arguments")
+			return
+		}
+		if tc.moved(i, c) {
+			return
+		}
+		tc.mu.Lock()
+		subs := append([]*server.Peer(nil), tc.subs[i]...)
+		tc.mu.Unlock()
+		for _, sub := range subs {
+			sub.Block(func(w *server.Writer) {
+				w.WriteLen(3)
+				w.WriteBulk("smessage")
+				w.WriteBulk(args[0])
+				w.WriteBulk(args[1])
+				w.Flush()
+			})
+		}
+		c.WriteInt(len(subs))
+	})
+}
+
+func (tc *testCluster) unsubscribe(i int, c *server.Peer) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for j, sub := range tc.subs[i] {
+		if sub == c {
+			tc.subs[i] = append(tc.subs[i][:j], tc.subs[i][j+1:]...)
+			return
+		}
+	}
+}
+
+// waitSubscribed waits until node i has a subscriber.
+func (tc *testCluster) waitSubscribed(i int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tc.mu.Lock()
+		n := len(tc.subs[i])
+		tc.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			tc.t.Fatalf("No subscriber on node %d", i)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// migrate moves the slots to node i, and unsubscribes the clients of the
+// previous owner as Redis does.
+func (tc *testCluster) migrate(i int) {
+	prev := int(atomic.SwapInt32(&tc.owner, int32(i)))
+	tc.mu.Lock()
+	subs := tc.subs[prev]
+	delete(tc.subs, prev)
+	tc.mu.Unlock()
+	for _, sub := range subs {
+		sub.Block(func(w *server.Writer) {
+			w.WriteLen(3)
+			w.WriteBulk("sunsubscribe")
+			w.WriteBulk(name)
+			w.WriteInt(0)
+			w.Flush()
+		})
+	}
+}
+
+func TestRedisCluster(t *testing.T) {
+	defer func(b backoff) { retryBackoff = b }(retryBackoff)
+	retryBackoff = backoff{min: 10 * time.Millisecond, max: 10 * time.Millisecond}
+
+	tc := newTestCluster(t, 2)
+	opt := &RedisOptions{
+		UniversalOptions: redis.UniversalOptions{Addrs: tc.addrs()},
+		ClusterMode:      true,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub, err := NewRedisTransport(opt, name, &Codec{}, nil, clog.P{})
+	if err != nil {
+		t.Fatalf("failed connect %s", err)
+	}
+	defer sub.Close()
+	ch := sub.Subscribe(ctx)
+	tc.waitSubscribed(0)
+
+	pub, err := NewRedisTransport(opt, name, &Codec{}, nil, clog.P{})
+	if err != nil {
+		t.Fatalf("failed connect %s", err)
+	}
+	defer pub.Close()
+
+	if err := pub.PublishBatch(ctx, []*AnswerCache{testAnswer("a.example.org."), testAnswer("b.example.org.")}); err != nil {
+		t.Fatalf("failed publish %s", err)
+	}
+	receive(t, ch, "a.example.org.")
+	receive(t, ch, "b.example.org.")
+
+	// The slot of the channel moves, and both ends follow it.
+	tc.migrate(1)
+	tc.waitSubscribed(1)
+	if err := pub.Publish(ctx, testAnswer("after.example.org.")); err != nil {
+		t.Fatalf("failed publish after the migration %s", err)
+	}
+	receive(t, ch, "after.example.org.")
+}
+
+func TestPublishSkipsUnencodable(t *testing.T) {
+	s := miniredis.RunT(t)
+	d := New(s.Addr())
+	if err := d.startup(); err != nil {
+		t.Fatalf("failed connect %s", err)
+	}
+	defer d.shutdown()
+
+	opt := &RedisOptions{UniversalOptions: redis.UniversalOptions{Addrs: []string{s.Addr()}}}
+	sub, err := NewRedisTransport(opt, name, &Codec{}, nil, clog.P{})
+	if err != nil {
+		t.Fatalf("failed connect %s", err)
+	}
+	defer sub.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := sub.Subscribe(ctx)
+
+	// A question name that is not fully qualified cannot be packed.
+	bad := testAnswer("bad.example.org.")
+	bad.Response.Question[0].Name = "bad"
+
+	if err := d.publish(ctx, testAnswer("a.example.org."), bad, testAnswer("b.example.org.")); err != nil {
+		t.Fatalf("Expected the batch published without the bad entry, got %s", err)
+	}
+	receive(t, ch, "a.example.org.")
+	receive(t, ch, "b.example.org.")
+
+	if err := d.publish(ctx, bad); err != nil {
+		t.Fatalf("Expected the bad entry skipped, got %s", err)
+	}
+	if err := d.publish(ctx, testAnswer("c.example.org.")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, ch, "c.example.org.")
+	if state := d.health.State(); state != StateUp {
+		t.Errorf("Expected %s after skipping the bad entry, got %s", StateUp, state)
+	}
+}
@@ -1,10 +1,17 @@
 package dcache
 
 import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
 )
 
 func init() {
@@ -13,27 +20,24 @@ func init() {
 
 func setup(c *caddy.Controller) error {
 	var log = clog.NewWithPlugin(name)
-	for i := 2; i != 0; i-- {
-		if !c.Next() {
-			return c.SyntaxErr("dcache redishost:port")
-		}
-	}
-
-	host := c.Val()
-
-	log.Infof("dcache connect to host name %s", host)
-
-	dcache := New(host)
-	dcache.log = log
 
-	if err := dcache.connect(); err != nil {
+	dcache, err := parse(c)
+	if err != nil {
 		return plugin.Error(name, err)
 	}
+	dcache.log = log
+
+	c.OnStartup(func() error {
+		log.Infof("dcache connect to %s with %s transport", dcache.Addr, dcache.TransportType)
 
-	log.Info("redis connect success")
+		if err := dcache.startup(); err != nil {
+			return plugin.Error(name, err)
+		}
+		return nil
+	})
 
-	go dcache.runSubscribe()
-	go dcache.runPublish()
+	// OnShutdown also runs for the old instance when the Corefile is reloaded.
+	c.OnShutdown(dcache.shutdown)
 
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		dcache.Next = next
@@ -42,3 +46,444 @@ func setup(c *caddy.Controller) error {
 
 	return nil
 }
+
+// parse parses the dcache directive.
+//
+//	dcache redishost:port {
+//	    transport redis|stream|memory
+//	    stream_maxlen LENGTH
+//	    replay SECONDS
+//	    snapshot
+//	    success CAPACITY
+//	    error CAPACITY [TTL] [MINTTL]
+//	    encoding json|binary
+//	    hmac KEYID SECRET|env NAME|file PATH
+//	    channel NAME
+//	    sentinel MASTER [ADDRESS...]
+//	    cluster [ADDRESS...]
+//	    tls [CERT KEY] [CA]
+//	    username USERNAME
+//	    password PASSWORD|env NAME|file PATH
+//	    db INDEX
+//	    publish_queue SIZE [drop_newest|drop_oldest|coalesce]
+//	    publish_workers COUNT
+//	    publish_batch SIZE [WINDOW]
+//	    min_ttl SECONDS
+//	    max_ttl SECONDS
+//	    zones ZONES...
+//	    startup fail|continue
+//	    prefetch AMOUNT [[DURATION] [PERCENTAGE%]]
+//	    serve_stale [SECONDS]
+//	    coalesce [WAIT]
+//	    lookup [MILLISECONDS]
+//	}
+func parse(c *caddy.Controller) (*Dcache, error) {
+	var d *Dcache
+
+	for c.Next() {
+		if d != nil {
+			return nil, plugin.ErrOnce
+		}
+
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return nil, c.SyntaxErr("dcache redishost:port")
+		}
+		if _, _, err := net.SplitHostPort(args[0]); err != nil {
+			return nil, c.Errf("invalid redis address '%s': %s", args[0], err)
+		}
+		d = New(args[0])
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "success":
+				size, err := parseCapacity(c)
+				if err != nil {
+					return nil, err
+				}
+				d.successCache, _ = NewCacheRepository(size)
+			case "error":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 3 {
+					return nil, c.ArgErr()
+				}
+				size, err := strconv.Atoi(args[0])
+				if err != nil || size <= 0 {
+					return nil, c.Errf("error: invalid capacity '%s'", args[0])
+				}
+				d.errorCache, _ = NewCacheRepository(size)
+				if len(args) > 1 {
+					n, err := strconv.Atoi(args[1])
+					if err != nil || n <= 0 {
+						return nil, c.Errf("error: invalid ttl '%s'", args[1])
+					}
+					d.ErrorMaxTTL = time.Duration(n) * time.Second
+				}
+				if len(args) > 2 {
+					n, err := strconv.Atoi(args[2])
+					if err != nil || n < 0 {
+						return nil, c.Errf("error: invalid minimum ttl '%s'", args[2])
+					}
+					d.ErrorMinTTL = time.Duration(n) * time.Second
+					if d.ErrorMinTTL > d.ErrorMaxTTL {
+						return nil, c.Errf("error: minimum ttl %s must not be greater than ttl %s", d.ErrorMinTTL, d.ErrorMaxTTL)
+					}
+				}
+				// A TTL below the default minimum lowers the minimum with it.
+				if d.ErrorMinTTL > d.ErrorMaxTTL {
+					d.ErrorMinTTL = d.ErrorMaxTTL
+				}
+			case "transport":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case transportRedis, transportStream, transportMemory:
+					d.TransportType = c.Val()
+				default:
+					return nil, c.Errf("unknown transport '%s'", c.Val())
+				}
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+			case "stream_maxlen":
+				n, err := parseCapacity(c)
+				if err != nil {
+					return nil, err
+				}
+				d.StreamMaxLen = int64(n)
+			case "replay":
+				n, err := parseUint(c)
+				if err != nil {
+					return nil, err
+				}
+				d.Replay = time.Duration(n) * time.Second
+			case "snapshot":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				d.Snapshot = true
+			case "encoding":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case encodingJSON, encodingBinary:
+					d.Encoding = c.Val()
+				default:
+					return nil, c.Errf("unknown encoding '%s'", c.Val())
+				}
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+			case "hmac":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return nil, c.ArgErr()
+				}
+				if len(args[0]) > 0xff {
+					return nil, c.Errf("hmac: key id '%s' too long", args[0])
+				}
+				for _, k := range d.Keys {
+					if k.ID == args[0] {
+						return nil, c.Errf("hmac: duplicate key id '%s'", args[0])
+					}
+				}
+				secret, err := parseSecret(c, "hmac", args[1:])
+				if err != nil {
+					return nil, err
+				}
+				d.Keys = append(d.Keys, Key{ID: args[0], Secret: []byte(secret)})
+			case "channel":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				d.Channel = c.Val()
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+			case "sentinel":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				addrs, err := parseAddrs(c, args[1:])
+				if err != nil {
+					return nil, err
+				}
+				d.MasterName = args[0]
+				d.Addrs = addrs
+			case "cluster":
+				addrs, err := parseAddrs(c, c.RemainingArgs())
+				if err != nil {
+					return nil, err
+				}
+				d.Cluster = true
+				d.Addrs = addrs
+			case "tls":
+				args := c.RemainingArgs()
+				if len(args) > 3 {
+					return nil, c.ArgErr()
+				}
+				cfg, err := pkgtls.NewTLSConfigFromArgs(args...)
+				if err != nil {
+					return nil, c.Errf("tls: %s", err)
+				}
+				d.TLSConfig = cfg
+			case "username":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				d.Username = c.Val()
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+			case "password":
+				password, err := parseSecret(c, "password", c.RemainingArgs())
+				if err != nil {
+					return nil, err
+				}
+				d.Password = password
+			case "db":
+				n, err := parseUint(c)
+				if err != nil {
+					return nil, err
+				}
+				d.DB = n
+			case "publish_queue":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n <= 0 {
+					return nil, c.Errf("publish_queue: invalid size '%s'", args[0])
+				}
+				d.QueueLimit = n
+				if len(args) == 2 {
+					switch args[1] {
+					case dropNewest, dropOldest, coalesce:
+						d.QueuePolicy = args[1]
+					default:
+						return nil, c.Errf("publish_queue: unknown policy '%s'", args[1])
+					}
+				}
+			case "publish_workers":
+				n, err := parseCapacity(c)
+				if err != nil {
+					return nil, err
+				}
+				d.Workers = n
+			case "publish_batch":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n <= 0 {
+					return nil, c.Errf("publish_batch: invalid size '%s'", args[0])
+				}
+				d.BatchSize = n
+				if len(args) == 2 {
+					w, err := time.ParseDuration(args[1])
+					if err != nil || w < 0 {
+						return nil, c.Errf("publish_batch: invalid window '%s'", args[1])
+					}
+					d.BatchWindow = w
+				}
+			case "min_ttl":
+				n, err := parseUint(c)
+				if err != nil {
+					return nil, err
+				}
+				d.MinTTL = time.Duration(n) * time.Second
+			case "max_ttl":
+				n, err := parseUint(c)
+				if err != nil {
+					return nil, err
+				}
+				d.MaxTTL = time.Duration(n) * time.Second
+			case "zones":
+				zones := c.RemainingArgs()
+				if len(zones) == 0 {
+					return nil, c.ArgErr()
+				}
+				d.Zones = nil
+				for _, z := range zones {
+					d.Zones = append(d.Zones, plugin.Host(z).NormalizeExact()...)
+				}
+			case "startup":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case startupFail, startupContinue:
+					d.Startup = c.Val()
+				default:
+					return nil, c.Errf("startup: unknown policy '%s'", c.Val())
+				}
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+			case "prefetch":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 3 {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n <= 0 {
+					return nil, c.Errf("prefetch: invalid amount '%s'", args[0])
+				}
+				d.Prefetch = n
+				if len(args) > 1 {
+					dur, err := time.ParseDuration(args[1])
+					if err != nil || dur <= 0 {
+						return nil, c.Errf("prefetch: invalid duration '%s'", args[1])
+					}
+					d.PrefetchDuration = dur
+				}
+				if len(args) > 2 {
+					pct := strings.TrimSuffix(args[2], "%")
+					n, err := strconv.Atoi(pct)
+					if err != nil || pct == args[2] || n < 10 || n > 90 {
+						return nil, c.Errf("prefetch: percentage must be between 10%% and 90%%, got '%s'", args[2])
+					}
+					d.PrefetchPercentage = n
+				}
+			case "serve_stale":
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return nil, c.ArgErr()
+				}
+				d.ServeStale = defaultServeStale
+				if len(args) == 1 {
+					n, err := strconv.Atoi(args[0])
+					if err != nil || n <= 0 {
+						return nil, c.Errf("serve_stale: invalid window '%s'", args[0])
+					}
+					d.ServeStale = time.Duration(n) * time.Second
+				}
+			case "coalesce":
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return nil, c.ArgErr()
+				}
+				d.Coalesce = defaultCoalesce
+				if len(args) == 1 {
+					w, err := time.ParseDuration(args[0])
+					if err != nil || w <= 0 {
+						return nil, c.Errf("coalesce: invalid wait '%s'", args[0])
+					}
+					d.Coalesce = w
+				}
+			case "lookup":
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return nil, c.ArgErr()
+				}
+				d.Lookup = defaultLookup
+				if len(args) == 1 {
+					n, err := strconv.Atoi(args[0])
+					if err != nil || n <= 0 {
+						return nil, c.Errf("lookup: invalid timeout '%s'", args[0])
+					}
+					d.Lookup = time.Duration(n) * time.Millisecond
+				}
+			default:
+				return nil, c.Errf("unknown property '%s'", c.Val())
+			}
+		}
+
+		// The repositories keep expired entries for the stale window.
+		d.successCache.stale = int64(d.ServeStale / time.Second)
+		d.errorCache.stale = int64(d.ServeStale / time.Second)
+
+		if d.Snapshot && d.TransportType == transportMemory {
+			return nil, c.Errf("snapshot requires a redis transport")
+		}
+
+		if d.Lookup > 0 && !d.Snapshot {
+			return nil, c.Errf("lookup requires snapshot")
+		}
+
+		if d.MasterName != "" && d.Cluster {
+			return nil, c.Errf("sentinel and cluster are mutually exclusive")
+		}
+
+		if d.Cluster && d.DB != 0 {
+			return nil, c.Errf("cluster supports only db 0, got %d", d.DB)
+		}
+
+		if d.MaxTTL > 0 && d.MinTTL > d.MaxTTL {
+			return nil, c.Errf("min_ttl %s must not be greater than max_ttl %s", d.MinTTL, d.MaxTTL)
+		}
+	}
+
+	if d == nil {
+		return nil, c.SyntaxErr("dcache redishost:port")
+	}
+
+	return d, nil
+}
+
+// parseAddrs validates the host:port addresses in args.
+func parseAddrs(c *caddy.Controller, args []string) ([]string, error) {
+	for _, a := range args {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return nil, c.Errf("invalid redis address '%s': %s", a, err)
+		}
+	}
+	return args, nil
+}
+
+// parseSecret reads the secret of the property prop given literally in args,
+// or with "env NAME" from an environment variable or with "file PATH" from a file.
+func parseSecret(c *caddy.Controller, prop string, args []string) (string, error) {
+	switch {
+	case len(args) == 1:
+		return args[0], nil
+	case len(args) == 2 && args[0] == "env":
+		v, ok := os.LookupEnv(args[1])
+		if !ok {
+			return "", c.Errf("%s: environment variable '%s' is not set", prop, args[1])
+		}
+		return v, nil
+	case len(args) == 2 && args[0] == "file":
+		b, err := os.ReadFile(args[1])
+		if err != nil {
+			return "", c.Errf("%s: %s", prop, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return "", c.ArgErr()
+}
+
+// parseUint reads exactly one non-negative integer argument.
+func parseUint(c *caddy.Controller) (int, error) {
+	prop := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return 0, c.ArgErr()
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, c.Errf("%s: invalid value '%s'", prop, args[0])
+	}
+	if n < 0 {
+		return 0, c.Errf("%s: value must not be negative, got %d", prop, n)
+	}
+	return n, nil
+}
+
+// parseCapacity reads exactly one positive integer argument.
+func parseCapacity(c *caddy.Controller) (int, error) {
+	prop := c.Val()
+	n, err := parseUint(c)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, c.Errf("%s: value must be positive", prop)
+	}
+	return n, nil
+}
@@ -1,9 +1,26 @@
 package dcache
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/coredns/caddy"
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
 )
 
 func TestSetup(t *testing.T) {
@@ -18,8 +35,630 @@ func TestSetup(t *testing.T) {
 		t.Fatalf("Expected errors, but got no error")
 	}
 
-	c = caddy.NewTestController("dns", `dcache 127.0.0.1:6379`)
+	c = caddy.NewTestController("dns", `dcache 127.0.0.1:6379 {
+		transport memory
+	}`)
 	if err := setup(c); err != nil {
 		t.Fatalf("Expected no errors, but got: %v", err)
 	}
 }
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input      string
+		shouldErr  bool
+		channel    string
+		password   string
+		db         int
+		queueLimit int
+		minTTL     time.Duration
+		maxTTL     time.Duration
+		zones      []string
+	}{
+		{`dcache 127.0.0.1:6379`, false, name, "", 0, defaultQueueLimit, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			success 100
+			error 50 600 10
+			transport stream
+			stream_maxlen 1000
+			replay 60
+			snapshot
+			encoding binary
+			hmac 2022 secret
+			hmac 2021 old
+			channel shared
+			password secret
+			db 2
+			publish_queue 500 coalesce
+			publish_workers 8
+			publish_batch 100 5ms
+			min_ttl 5
+			max_ttl 300
+			zones example.org Example.COM.
+			startup continue
+			prefetch 10 1m 20%
+			serve_stale 600
+			coalesce 100ms
+			lookup 5
+		}`, false, "shared", "secret", 2, 500, 5 * time.Second, 300 * time.Second, []string{"example.org.", "example.com."}},
+
+		// fails
+		{`dcache`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 127.0.0.2:6379`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			success 0
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			error abc
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			error 50 0
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			error 50 10 60
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			error 50 600 10 5
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			channel
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			db -1
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			min_ttl 60
+			max_ttl 10
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			zones
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			publish_queue 10 drop_random
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			publish_queue 0
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			publish_workers 0
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			publish_batch 10 soon
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			encoding xml
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			hmac 2022
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			hmac 2022 secret
+			hmac 2022 other
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			stream_maxlen 0
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			replay -1
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			transport memory
+			snapshot
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			transport carrier-pigeon
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			startup maybe
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			serve_stale 0
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			prefetch 10 1m 95%
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			prefetch 10 1m 20
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			prefetch 0
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			coalesce 0s
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			coalesce 100
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			lookup 5
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			snapshot
+			lookup 0
+		}`, true, "", "", 0, 0, 0, 0, nil},
+		{`dcache 127.0.0.1:6379 {
+			unknown 1
+		}`, true, "", "", 0, 0, 0, 0, nil},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		d, err := parse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			continue
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+
+		if d.Channel != test.channel {
+			t.Errorf("Test %d: expected channel %s, got %s", i, test.channel, d.Channel)
+		}
+		if d.Password != test.password {
+			t.Errorf("Test %d: expected password %s, got %s", i, test.password, d.Password)
+		}
+		if d.DB != test.db {
+			t.Errorf("Test %d: expected db %d, got %d", i, test.db, d.DB)
+		}
+		if d.QueueLimit != test.queueLimit {
+			t.Errorf("Test %d: expected publish_queue %d, got %d", i, test.queueLimit, d.QueueLimit)
+		}
+		if d.MinTTL != test.minTTL {
+			t.Errorf("Test %d: expected min_ttl %s, got %s", i, test.minTTL, d.MinTTL)
+		}
+		if d.MaxTTL != test.maxTTL {
+			t.Errorf("Test %d: expected max_ttl %s, got %s", i, test.maxTTL, d.MaxTTL)
+		}
+		if !reflect.DeepEqual(d.Zones, test.zones) {
+			t.Errorf("Test %d: expected zones %v, got %v", i, test.zones, d.Zones)
+		}
+	}
+}
+
+func TestShutdownNoLeak(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	for _, transport := range []string{transportMemory, transportRedis, transportStream} {
+		before := runtime.NumGoroutine()
+
+		for i := 0; i < 5; i++ {
+			c := caddy.NewTestController("dns", fmt.Sprintf(`dcache %s {
+				transport %s
+				snapshot
+			}`, s.Addr(), transport))
+			if transport == transportMemory {
+				c = caddy.NewTestController("dns", `dcache 127.0.0.1:6379 {
+					transport memory
+				}`)
+			}
+			d, err := parse(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := d.startup(); err != nil {
+				t.Fatal(err)
+			}
+			d.enqueue(testAnswer("example.org."))
+			if err := d.shutdown(); err != nil {
+				t.Fatal(err)
+			}
+			if d.queue.len() != 0 {
+				t.Errorf("Expected %s queue drained at shutdown", transport)
+			}
+		}
+
+		after := runtime.NumGoroutine()
+		for i := 0; i < 50 && after > before; i++ {
+			time.Sleep(20 * time.Millisecond)
+			after = runtime.NumGoroutine()
+		}
+		if after > before {
+			t.Errorf("Expected no leaked goroutines with %s transport, got %d before and %d after", transport, before, after)
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		input string
+		got   func(d *Dcache) interface{}
+		want  interface{}
+	}{
+		{`transport stream`, func(d *Dcache) interface{} { return d.TransportType }, transportStream},
+		{`stream_maxlen 1000`, func(d *Dcache) interface{} { return d.StreamMaxLen }, int64(1000)},
+		{`replay 60`, func(d *Dcache) interface{} { return d.Replay }, time.Minute},
+		{`snapshot`, func(d *Dcache) interface{} { return d.Snapshot }, true},
+		{`success 2560`, func(d *Dcache) interface{} { return d.successCache.size }, 2560},
+		{`success 100`, func(d *Dcache) interface{} { return d.successCache.size }, 100},
+		{`error 1280`, func(d *Dcache) interface{} { return d.errorCache.size }, 1280},
+		{`error 1280 600 10`, func(d *Dcache) interface{} { return []time.Duration{d.ErrorMaxTTL, d.ErrorMinTTL} }, []time.Duration{10 * time.Minute, 10 * time.Second}},
+		{`error 100 3`, func(d *Dcache) interface{} { return []time.Duration{d.ErrorMaxTTL, d.ErrorMinTTL} }, []time.Duration{3 * time.Second, 3 * time.Second}},
+		{`encoding binary`, func(d *Dcache) interface{} { return d.Encoding }, encodingBinary},
+		{"hmac 2022 new\nhmac 2021 old", func(d *Dcache) interface{} { return d.Keys }, []Key{{"2022", []byte("new")}, {"2021", []byte("old")}}},
+		{`channel shared`, func(d *Dcache) interface{} { return d.Channel }, "shared"},
+		{`db 2`, func(d *Dcache) interface{} { return d.DB }, 2},
+		{`publish_queue 500 coalesce`, func(d *Dcache) interface{} { return []interface{}{d.QueueLimit, d.QueuePolicy} }, []interface{}{500, "coalesce"}},
+		{`publish_workers 8`, func(d *Dcache) interface{} { return d.Workers }, 8},
+		{`publish_batch 100 5ms`, func(d *Dcache) interface{} { return []interface{}{d.BatchSize, d.BatchWindow} }, []interface{}{100, 5 * time.Millisecond}},
+		{`min_ttl 5`, func(d *Dcache) interface{} { return d.MinTTL }, 5 * time.Second},
+		{`max_ttl 300`, func(d *Dcache) interface{} { return d.MaxTTL }, 5 * time.Minute},
+		{`startup continue`, func(d *Dcache) interface{} { return d.Startup }, startupContinue},
+		{`prefetch 10`, func(d *Dcache) interface{} {
+			return []interface{}{d.Prefetch, d.PrefetchDuration, d.PrefetchPercentage}
+		}, []interface{}{10, defaultPrefetchDuration, defaultPrefetchPercentage}},
+		{`prefetch 10 5m 20%`, func(d *Dcache) interface{} {
+			return []interface{}{d.Prefetch, d.PrefetchDuration, d.PrefetchPercentage}
+		}, []interface{}{10, 5 * time.Minute, 20}},
+		{`serve_stale`, func(d *Dcache) interface{} { return d.ServeStale }, defaultServeStale},
+		{`serve_stale 600`, func(d *Dcache) interface{} {
+			return []int64{int64(d.ServeStale / time.Second), d.successCache.stale, d.errorCache.stale}
+		}, []int64{600, 600, 600}},
+		{`coalesce`, func(d *Dcache) interface{} { return d.Coalesce }, defaultCoalesce},
+		{`coalesce 50ms`, func(d *Dcache) interface{} { return d.Coalesce }, 50 * time.Millisecond},
+		{"snapshot\nlookup", func(d *Dcache) interface{} { return d.Lookup }, defaultLookup},
+		{"snapshot\nlookup 25", func(d *Dcache) interface{} { return d.Lookup }, 25 * time.Millisecond},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", "dcache 127.0.0.1:6379 {\n"+test.input+"\n}")
+		d, err := parse(c)
+		if err != nil {
+			t.Errorf("Test %d: expected no error for input %s, got: %v", i, test.input, err)
+			continue
+		}
+		if got := test.got(d); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Test %d: expected %v for input %s, got %v", i, test.want, test.input, got)
+		}
+	}
+
+	// One syntax error for every option.
+	for i, input := range []string{
+		`transport`,
+		`stream_maxlen abc`,
+		`replay abc`,
+		`snapshot now`,
+		`success`,
+		`error 50 abc`,
+		`encoding json binary`,
+		`hmac`,
+		`channel a b`,
+		`sentinel`,
+		`cluster 10.0.0.2`,
+		`tls a b c d`,
+		`username a b`,
+		`password`,
+		`db abc`,
+		`publish_queue`,
+		`publish_workers abc`,
+		`publish_batch 0`,
+		`min_ttl abc`,
+		`max_ttl -1`,
+		`zones`,
+		`startup`,
+		`prefetch 10 soon`,
+		`serve_stale abc`,
+		`coalesce 50ms 100ms`,
+		"snapshot\nlookup abc",
+	} {
+		c := caddy.NewTestController("dns", "dcache 127.0.0.1:6379 {\n"+input+"\n}")
+		if _, err := parse(c); err == nil {
+			t.Errorf("Test %d: expected error but found none for input %s", i, input)
+		}
+	}
+}
+
+func TestParseHMAC(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DCACHE_TEST_SECRET", "from-env")
+
+	tests := []struct {
+		input     string
+		shouldErr bool
+		secret    string
+	}{
+		{`hmac 2022 secret`, false, "secret"},
+		{`hmac 2022 env DCACHE_TEST_SECRET`, false, "from-env"},
+		{fmt.Sprintf(`hmac 2022 file %s`, file), false, "from-file"},
+
+		// fails
+		{`hmac 2022 env DCACHE_TEST_UNSET`, true, ""},
+		{fmt.Sprintf(`hmac 2022 file %s`, file+".missing"), true, ""},
+		{`hmac 2022 vault secret/dcache`, true, ""},
+		{`hmac 2022 env DCACHE_TEST_SECRET extra`, true, ""},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", "dcache 127.0.0.1:6379 {\n"+test.input+"\n}")
+		d, err := parse(c)
+
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			continue
+		}
+		if len(d.Keys) != 1 || string(d.Keys[0].Secret) != test.secret {
+			t.Errorf("Test %d: expected secret %s, got %v", i, test.secret, d.Keys)
+		}
+	}
+}
+
+func TestParseAuth(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "password")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DCACHE_TEST_PASSWORD", "from-env")
+	ca, cert, key := writeTestCerts(t, dir)
+
+	tests := []struct {
+		input     string
+		shouldErr bool
+		username  string
+		password  string
+		tls       bool
+	}{
+		{`dcache 127.0.0.1:6379 {
+			username dcache
+			password secret
+		}`, false, "dcache", "secret", false},
+		{`dcache 127.0.0.1:6379 {
+			password env DCACHE_TEST_PASSWORD
+		}`, false, "", "from-env", false},
+		{fmt.Sprintf(`dcache 127.0.0.1:6379 {
+			password file %s
+		}`, file), false, "", "from-file", false},
+		{`dcache 127.0.0.1:6379 {
+			tls
+		}`, false, "", "", true},
+		{fmt.Sprintf(`dcache 127.0.0.1:6379 {
+			tls %s %s %s
+		}`, cert, key, ca), false, "", "", true},
+
+		// fails
+		{`dcache 127.0.0.1:6379 {
+			username
+		}`, true, "", "", false},
+		{`dcache 127.0.0.1:6379 {
+			password
+		}`, true, "", "", false},
+		{`dcache 127.0.0.1:6379 {
+			password env DCACHE_TEST_UNSET
+		}`, true, "", "", false},
+		{fmt.Sprintf(`dcache 127.0.0.1:6379 {
+			password file %s
+		}`, filepath.Join(dir, "missing")), true, "", "", false},
+		{`dcache 127.0.0.1:6379 {
+			password vault secret/dcache
+		}`, true, "", "", false},
+		{`dcache 127.0.0.1:6379 {
+			tls missing.pem missing.key
+		}`, true, "", "", false},
+		{`dcache 127.0.0.1:6379 {
+			tls a b c d
+		}`, true, "", "", false},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		d, err := parse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			continue
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+
+		if d.Username != test.username {
+			t.Errorf("Test %d: expected username %s, got %s", i, test.username, d.Username)
+		}
+		if d.Password != test.password {
+			t.Errorf("Test %d: expected password %s, got %s", i, test.password, d.Password)
+		}
+		if (d.TLSConfig != nil) != test.tls {
+			t.Errorf("Test %d: expected tls %t, got %v", i, test.tls, d.TLSConfig)
+		}
+	}
+}
+
+func TestParseRedisMode(t *testing.T) {
+	tests := []struct {
+		input      string
+		shouldErr  bool
+		masterName string
+		cluster    bool
+		addrs      []string
+	}{
+		{`dcache 127.0.0.1:6379`, false, "", false, nil},
+		{`dcache 10.0.0.1:26379 {
+			sentinel mymaster 10.0.0.2:26379 10.0.0.3:26379
+		}`, false, "mymaster", false, []string{"10.0.0.2:26379", "10.0.0.3:26379"}},
+		{`dcache 10.0.0.1:26379 {
+			sentinel mymaster
+		}`, false, "mymaster", false, []string{}},
+		{`dcache 10.0.0.1:6379 {
+			cluster 10.0.0.2:6379
+		}`, false, "", true, []string{"10.0.0.2:6379"}},
+
+		// fails
+		{`dcache 10.0.0.1:26379 {
+			sentinel
+		}`, true, "", false, nil},
+		{`dcache 10.0.0.1:26379 {
+			sentinel mymaster 10.0.0.2
+		}`, true, "", false, nil},
+		{`dcache 10.0.0.1:6379 {
+			cluster 10.0.0.2
+		}`, true, "", false, nil},
+		{`dcache 10.0.0.1:6379 {
+			sentinel mymaster
+			cluster
+		}`, true, "", false, nil},
+		{`dcache 10.0.0.1:6379 {
+			cluster
+			db 1
+		}`, true, "", false, nil},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		d, err := parse(c)
+
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			continue
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+			continue
+		}
+		if test.shouldErr {
+			continue
+		}
+
+		if d.MasterName != test.masterName {
+			t.Errorf("Test %d: expected sentinel master %s, got %s", i, test.masterName, d.MasterName)
+		}
+		if d.Cluster != test.cluster {
+			t.Errorf("Test %d: expected cluster %t, got %t", i, test.cluster, d.Cluster)
+		}
+		if !reflect.DeepEqual(d.Addrs, test.addrs) {
+			t.Errorf("Test %d: expected addresses %v, got %v", i, test.addrs, d.Addrs)
+		}
+	}
+}
+
+func TestRedisTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, cert, key := writeTestCerts(t, dir)
+
+	// The server requires a client certificate signed by the CA, and an ACL user.
+	serverCfg, err := pkgtls.NewTLSConfig(cert, key, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCfg.ClientCAs = serverCfg.RootCAs
+	serverCfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	s, err := miniredis.RunTLS(serverCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.RequireUserAuth("dcache", "secret")
+
+	tests := []struct {
+		block     string
+		shouldErr bool
+	}{
+		{fmt.Sprintf("tls %s %s %s\nusername dcache\npassword secret\ndb 2", cert, key, ca), false},
+		// Without a client certificate.
+		{fmt.Sprintf("tls %s\nusername dcache\npassword secret", ca), true},
+		{fmt.Sprintf("tls %s %s %s\nusername dcache\npassword wrong", cert, key, ca), true},
+		{"username dcache\npassword secret", true},
+	}
+
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", fmt.Sprintf("dcache %s {\nsnapshot\n%s\n}", s.Addr(), tc.block))
+		d, err := parse(c)
+		if err != nil {
+			t.Fatalf("Test %d: %s", i, err)
+		}
+
+		err = d.startup()
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error connecting, got none", i)
+				_ = d.shutdown()
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got %s", i, err)
+		}
+
+		d.enqueue(testAnswer("example.org."))
+		if err := d.shutdown(); err != nil {
+			t.Fatal(err)
+		}
+		// The entry published at shutdown is in the snapshot of db 2.
+		if keys := s.DB(2).Keys(); len(keys) != 1 {
+			t.Errorf("Test %d: expected 1 snapshot key in db 2, got %v", i, keys)
+		}
+	}
+}
+
+// writeTestCerts writes a CA, and a certificate for 127.0.0.1 signed by it, to dir.
+func writeTestCerts(t *testing.T, dir string) (ca, cert, key string) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dcache test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, certTmpl, caTmpl, &certKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name, typ string, b []byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	return write("ca.pem", "CERTIFICATE", caDER), write("cert.pem", "CERTIFICATE", certDER), write("key.pem", "EC PRIVATE KEY", keyDER)
+}
@@ -0,0 +1,62 @@
+package dcache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// A signed entry is signedMagic, the length prefixed key ID, the HMAC-SHA256
+// of the key ID and the payload, and the payload.
+const signedMagic = 0xd5
+
+var errSignature = errors.New("invalid signature")
+
+func mac(key Key, payload []byte) []byte {
+	h := hmac.New(sha256.New, key.Secret)
+	h.Write([]byte{byte(len(key.ID))})
+	h.Write([]byte(key.ID))
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// sign returns payload signed with key.
+func sign(key Key, payload []byte) []byte {
+	b := make([]byte, 0, 2+len(key.ID)+sha256.Size+len(payload))
+	b = append(b, signedMagic, byte(len(key.ID)))
+	b = append(b, key.ID...)
+	b = append(b, mac(key, payload)...)
+	return append(b, payload...)
+}
+
+// verify checks the signature of data with the key of the same ID in keys,
+// and returns the payload. Without keys the signature is not checked, so that
+// nodes which do not sign can still read signed entries.
+func verify(keys []Key, data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != signedMagic {
+		return nil, fmt.Errorf("%w: entry is not signed", errSignature)
+	}
+	n := int(data[1])
+	if len(data) < 2+n+sha256.Size {
+		return nil, fmt.Errorf("%w: entry too short", errSignature)
+	}
+	id := string(data[2 : 2+n])
+	sum := data[2+n : 2+n+sha256.Size]
+	payload := data[2+n+sha256.Size:]
+
+	if len(keys) == 0 {
+		return payload, nil
+	}
+
+	for _, k := range keys {
+		if k.ID != id {
+			continue
+		}
+		if !hmac.Equal(sum, mac(k, payload)) {
+			return nil, fmt.Errorf("%w: mismatch for key %q", errSignature, id)
+		}
+		return payload, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", errSignature, id)
+}
@@ -0,0 +1,49 @@
+package dcache
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCodecSignature(t *testing.T) {
+	old := Key{ID: "2021", Secret: []byte("old secret")}
+	cur := Key{ID: "2022", Secret: []byte("new secret")}
+
+	tests := []struct {
+		sender   *Codec
+		receiver *Codec
+		err      error
+	}{
+		{&Codec{Keys: []Key{cur}}, &Codec{Keys: []Key{cur}}, nil},
+		// Rotation: receivers accept every configured key.
+		{&Codec{Keys: []Key{old}}, &Codec{Keys: []Key{cur, old}}, nil},
+		{&Codec{Encoding: encodingBinary, Keys: []Key{cur, old}}, &Codec{Keys: []Key{cur}}, nil},
+		{&Codec{Keys: []Key{old}}, &Codec{Keys: []Key{cur}}, errSignature},
+		{&Codec{Keys: []Key{{ID: "2022", Secret: []byte("forged")}}}, &Codec{Keys: []Key{cur}}, errSignature},
+		{&Codec{}, &Codec{Keys: []Key{cur}}, errSignature},
+		// Receivers without keys read signed entries.
+		{&Codec{Keys: []Key{cur}}, &Codec{}, nil},
+	}
+
+	for i, tc := range tests {
+		b, err := tc.sender.Encode(testCodecAnswer())
+		if err != nil {
+			t.Fatalf("Test %d: failed encode %s", i, err)
+		}
+		_, err = tc.receiver.Decode(b)
+		if tc.err == nil && err != nil {
+			t.Errorf("Test %d: expected no error, got %s", i, err)
+		}
+		if tc.err != nil && !errors.Is(err, tc.err) {
+			t.Errorf("Test %d: expected %s, got %v", i, tc.err, err)
+		}
+	}
+
+	// Tampering with the payload breaks the signature.
+	codec := &Codec{Keys: []Key{cur}}
+	b, _ := codec.Encode(testCodecAnswer())
+	b[len(b)-1] ^= 0xff
+	if _, err := codec.Decode(b); !errors.Is(err, errSignature) {
+		t.Errorf("Expected %s for tampered entry, got %v", errSignature, err)
+	}
+}
@@ -0,0 +1,185 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	snapshotScanCount   = 1000
+	snapshotLoadTimeout = 30 * time.Second
+)
+
+// RedisSnapshot keeps every published entry in Redis until its TimeToDie,
+// so that a newly started node can load the entries still valid.
+type RedisSnapshot struct {
+	log    clog.P
+	prefix string
+	codec  *Codec
+	con    redis.UniversalClient
+}
+
+// NewRedisSnapshot connects to the Redis deployment described by opt and stores
+// entries encoded by codec under keys starting with prefix.
+func NewRedisSnapshot(opt *RedisOptions, prefix string, codec *Codec, log clog.P) (*RedisSnapshot, error) {
+	s := &RedisSnapshot{
+		log:    log,
+		prefix: prefix,
+		codec:  codec,
+		con:    opt.newClient(opt.PoolSize),
+	}
+
+	if cmd := s.con.Ping(context.Background()); cmd.Err() != nil {
+		log.Error("failed connect redis", cmd.Err())
+		_ = s.Close()
+		return nil, cmd.Err()
+	}
+
+	return s, nil
+}
+
+func (s *RedisSnapshot) key(ans *AnswerCache) string {
+	return s.hashKey(ans.key())
+}
+
+func (s *RedisSnapshot) hashKey(h uint64) string {
+	return fmt.Sprintf("%s%016x", s.prefix, h)
+}
+
+// Save stores every entry of ans until its TimeToDie in a single pipeline.
+// Expired entries are not stored.
+func (s *RedisSnapshot) Save(ctx context.Context, ans ...*AnswerCache) error {
+	_, err := s.con.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, a := range ans {
+			ttl := time.Until(time.Unix(a.TimeToDie, 0))
+			if ttl < time.Second {
+				continue
+			}
+
+			// An entry that cannot be encoded was skipped when it was published.
+			b, err := s.codec.Encode(a)
+			if err != nil {
+				continue
+			}
+			p.Set(ctx, s.key(a), b, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+// Get returns the entry stored for the question hashed to key, and reports
+// whether one is stored and still valid at now.
+func (s *RedisSnapshot) Get(ctx context.Context, now int64, key uint64) (*AnswerCache, bool, error) {
+	p, err := s.con.Get(ctx, s.hashKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	ans, err := s.codec.Decode(p)
+	if err != nil {
+		rejectEntry(ctx, s.log, err)
+		return nil, false, nil
+	}
+	if ans.TimeToDie < now {
+		return nil, false, nil
+	}
+	return ans, true, nil
+}
+
+// Load calls fn for every entry in the snapshot that is still valid at now.
+// It returns the number of entries loaded.
+func (s *RedisSnapshot) Load(ctx context.Context, now int64, fn func(*AnswerCache)) (int, error) {
+	c, ok := s.con.(*redis.ClusterClient)
+	if !ok {
+		return s.load(ctx, s.con, now, fn)
+	}
+
+	// SCAN only sees the keys of one node, so every master is scanned.
+	var mu sync.Mutex
+	n := 0
+	err := c.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		m, err := s.load(ctx, node, now, func(ans *AnswerCache) {
+			mu.Lock()
+			defer mu.Unlock()
+			fn(ans)
+		})
+		mu.Lock()
+		n += m
+		mu.Unlock()
+		return err
+	})
+	return n, err
+}
+
+// load reads the snapshot entries on con. Keys are read with pipelined GETs
+// rather than MGET, which a Redis Cluster rejects for keys in different slots.
+func (s *RedisSnapshot) load(ctx context.Context, con redis.UniversalClient, now int64, fn func(*AnswerCache)) (int, error) {
+	n := 0
+	iter := con.Scan(ctx, 0, s.prefix+"*", snapshotScanCount).Iterator()
+
+	keys := make([]string, 0, snapshotScanCount)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		cmds, err := con.Pipelined(ctx, func(p redis.Pipeliner) error {
+			for _, k := range keys {
+				p.Get(ctx, k)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		keys = keys[:0]
+
+		for _, cmd := range cmds {
+			// The key expired between SCAN and GET.
+			p, err := cmd.(*redis.StringCmd).Bytes()
+			if err != nil {
+				continue
+			}
+
+			ans, err := s.codec.Decode(p)
+			if err != nil {
+				rejectEntry(ctx, s.log, err)
+				continue
+			}
+			if ans.TimeToDie < now {
+				continue
+			}
+			fn(ans)
+			n++
+		}
+		return nil
+	}
+
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == snapshotScanCount {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return n, err
+	}
+
+	return n, flush()
+}
+
+// Close releases the connection of the snapshot.
+func (s *RedisSnapshot) Close() error {
+	return s.con.Close()
+}
@@ -0,0 +1,133 @@
+package dcache
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestSnapshot(t *testing.T) {
+	for _, cluster := range []bool{false, true} {
+		testSnapshot(t, cluster)
+	}
+}
+
+func testSnapshot(t *testing.T, cluster bool) {
+	s := withSPublish(miniredis.RunT(t))
+
+	a := New(s.Addr())
+	a.Cluster = cluster
+	a.Snapshot = true
+	if err := a.connect(); err != nil {
+		t.Fatalf("failed connect %s", err)
+	}
+	defer a.Transport.Close()
+
+	valid := testAnswer("valid.example.org.")
+	expired := testAnswer("expired.example.org.")
+	expired.TimeToDie = time.Now().Add(-time.Minute).Unix()
+	a.publish(context.Background(), valid)
+	a.publish(context.Background(), expired)
+
+	if n := len(s.Keys()); n != 1 {
+		t.Fatalf("Expected 1 entry in snapshot with cluster %t, got %d", cluster, n)
+	}
+
+	b := New(s.Addr())
+	b.Cluster = cluster
+	b.Snapshot = true
+	if err := b.connect(); err != nil {
+		t.Fatalf("failed connect %s", err)
+	}
+	defer b.Transport.Close()
+	if err := b.loadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("valid.example.org.", dns.TypeA)
+	state := &request.Request{W: &test.ResponseWriter{}, Req: req}
+	if _, ok := b.successCache.Get(time.Now().UTC().Unix(), state); !ok {
+		t.Errorf("Expected %s loaded from snapshot with cluster %t", state.Name(), cluster)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	a := New(s.Addr())
+	a.Snapshot = true
+	if err := a.connect(); err != nil {
+		t.Fatalf("failed connect %s", err)
+	}
+	defer a.Transport.Close()
+
+	var resolved int32
+	b := New(s.Addr())
+	b.Snapshot = true
+	b.Lookup = time.Second
+	b.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		atomic.AddInt32(&resolved, 1)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		_ = w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+	if err := b.startup(); err != nil {
+		t.Fatalf("failed startup %s", err)
+	}
+	defer b.shutdown()
+
+	// The entry is stored after b loaded the snapshot, and its message is lost.
+	ans := testAnswer("peer.example.org.")
+	ans.Response.Answer = []dns.RR{test.A("peer.example.org.	300	IN	A	192.0.2.1")}
+	if err := a.snapshot.Save(context.Background(), ans); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		qname    string
+		answer   bool
+		resolved int32
+	}{
+		{"peer.example.org.", true, 0},
+		// Answered from the local cache.
+		{"peer.example.org.", true, 0},
+		{"missing.example.org.", false, 1},
+	}
+
+	for i, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.qname, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := b.ServeDNS(context.TODO(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Msg != nil && len(rec.Msg.Answer) > 0; got != tc.answer {
+			t.Errorf("Test %d: expected answer %t, got %v", i, tc.answer, rec.Msg)
+		}
+		if n := atomic.LoadInt32(&resolved); n != tc.resolved {
+			t.Errorf("Test %d: expected %d resolutions, got %d", i, tc.resolved, n)
+		}
+	}
+
+	// A failing lookup falls back to the next plugin.
+	s.SetError("LOADING")
+	req := new(dns.Msg)
+	req.SetQuestion("other.example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := b.ServeDNS(context.TODO(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&resolved); n != 2 {
+		t.Errorf("Expected the next plugin after a failed lookup, got %d resolutions", n)
+	}
+}
@@ -0,0 +1,193 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultStreamMaxLen = 10000
+	streamField         = "entry"
+	streamReadCount     = 100
+	// streamBlock also bounds how long a subscriber takes to notice cancellation.
+	streamBlock = time.Second
+)
+
+// StreamTransport is a Transport on top of Redis Streams.
+// Unlike Pub/Sub, entries published while a subscriber is disconnected
+// are read when it reconnects, and a new subscriber can replay the recent window.
+type StreamTransport struct {
+	redisConns
+	log    clog.P
+	stream string
+	codec  *Codec
+	health *Health
+	maxLen int64
+	replay time.Duration
+}
+
+// NewStreamTransport connects to the Redis deployment described by opt and shares
+// entries on stream, encoded by codec. The stream is trimmed to about maxLen entries.
+// A new subscriber first reads the entries added in the last replay. The subscriber reports to health.
+func NewStreamTransport(opt *RedisOptions, stream string, codec *Codec, maxLen int64, replay time.Duration, health *Health, log clog.P) (*StreamTransport, error) {
+	conns, err := opt.dial(log)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamTransport{
+		redisConns: conns,
+		log:        log,
+		stream:     stream,
+		codec:      codec,
+		health:     health,
+		maxLen:     maxLen,
+		replay:     replay,
+	}, nil
+}
+
+// Publish implements the Transport interface.
+func (t *StreamTransport) Publish(ctx context.Context, ans *AnswerCache) error {
+	b, err := t.codec.Encode(ans)
+	if err != nil {
+		return err
+	}
+
+	return t.publishCon.XAdd(ctx, t.addArgs(b)).Err()
+}
+
+// PublishBatch implements the BatchPublisher interface with a single pipeline.
+// Entries that cannot be encoded are skipped.
+func (t *StreamTransport) PublishBatch(ctx context.Context, ans []*AnswerCache) error {
+	args := make([]*redis.XAddArgs, 0, len(ans))
+	for _, a := range ans {
+		b, err := t.codec.Encode(a)
+		if err != nil {
+			skipEntry(ctx, t.log, err)
+			continue
+		}
+		args = append(args, t.addArgs(b))
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	_, err := t.publishCon.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, a := range args {
+			p.XAdd(ctx, a)
+		}
+		return nil
+	})
+	return err
+}
+
+func (t *StreamTransport) addArgs(b []byte) *redis.XAddArgs {
+	return &redis.XAddArgs{
+		Stream: t.stream,
+		MaxLen: t.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{streamField: b},
+	}
+}
+
+// startID returns the ID after which a new subscriber starts reading.
+func (t *StreamTransport) startID(ctx context.Context) (string, error) {
+	if t.replay > 0 {
+		ms := time.Now().Add(-t.replay).UnixNano() / int64(time.Millisecond)
+		return fmt.Sprintf("%d-0", ms), nil
+	}
+
+	// Resolve "$" to a concrete ID, so that nothing is missed when the first read fails.
+	last, err := t.subscribeCon.XRevRangeN(ctx, t.stream, "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(last) == 0 {
+		return "0-0", nil
+	}
+	return last[0].ID, nil
+}
+
+// Subscribe implements the Transport interface.
+// The subscriber keeps the ID of the last entry read in memory, and resumes from
+// it after backing off from an error. A restarted node starts from the replay window.
+func (t *StreamTransport) Subscribe(ctx context.Context) <-chan *AnswerCache {
+	ch := make(chan *AnswerCache)
+
+	// The start is resolved before returning, so every entry published once
+	// Subscribe returned is read. When it fails, the subscriber resolves it again.
+	lastID, _ := t.startID(ctx)
+
+	go func() {
+		defer close(ch)
+
+		b := retryBackoff
+		healthy := false
+		for {
+			var err error
+			if lastID == "" {
+				lastID, err = t.startID(ctx)
+			}
+
+			var streams []redis.XStream
+			if err == nil {
+				streams, err = t.subscribeCon.XRead(ctx, &redis.XReadArgs{
+					Streams: []string{t.stream, lastID},
+					Count:   streamReadCount,
+					Block:   streamBlock,
+				}).Result()
+			}
+			if err != nil && !errors.Is(err, redis.Nil) {
+				if ctx.Err() != nil || errors.Is(err, redis.ErrClosed) {
+					return
+				}
+				t.log.Errorf("failed receive %s", err)
+				redisErr.WithLabelValues(metrics.WithServer(ctx)).Inc()
+				t.health.Report(ctx, routineSubscribe, err)
+				healthy = false
+
+				if !sleep(ctx, b.next()) {
+					return
+				}
+				continue
+			}
+			if !healthy {
+				t.health.Report(ctx, routineSubscribe, nil)
+				healthy = true
+				b.reset()
+			}
+
+			for _, s := range streams {
+				for _, m := range s.Messages {
+					lastID = m.ID
+
+					v, ok := m.Values[streamField].(string)
+					if !ok {
+						t.log.Errorf("unexpected stream entry %s %v", m.ID, m.Values)
+						continue
+					}
+
+					ans, err := t.codec.Decode([]byte(v))
+					if err != nil {
+						rejectEntry(ctx, t.log, err)
+						continue
+					}
+
+					select {
+					case ch <- ans:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return ch
+}
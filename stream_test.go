@@ -0,0 +1,90 @@
+package dcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestStreamTransport(t *testing.T, addr string, replay time.Duration) *StreamTransport {
+	st, err := NewStreamTransport(&RedisOptions{UniversalOptions: redis.UniversalOptions{Addrs: []string{addr}}}, name, &Codec{Encoding: encodingBinary}, 100, replay, nil, clog.P{})
+	if err != nil {
+		t.Fatalf("failed connect %s", err)
+	}
+	return st
+}
+
+func testAnswer(qname string) *AnswerCache {
+	m := new(dns.Msg)
+	m.SetQuestion(qname, dns.TypeA)
+	return &AnswerCache{
+		Name:      qname,
+		Response:  m,
+		Type:      dns.Type(dns.TypeA),
+		TimeToDie: time.Now().Add(time.Minute).Unix(),
+		By:        "test",
+	}
+}
+
+func receive(t *testing.T, ch <-chan *AnswerCache, qname string) {
+	select {
+	case ans, ok := <-ch:
+		if !ok {
+			t.Fatalf("Subscription closed before %s", qname)
+		}
+		if ans.Name != qname {
+			t.Fatalf("Expected %s, got %s", qname, ans.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for %s", qname)
+	}
+}
+
+func TestStreamTransportReplay(t *testing.T) {
+	s := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pub := newTestStreamTransport(t, s.Addr(), 0)
+	defer pub.Close()
+	if err := pub.Publish(ctx, testAnswer("a.example.org.")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A node started later replays what was published before it subscribed.
+	sub := newTestStreamTransport(t, s.Addr(), time.Minute)
+	defer sub.Close()
+	ch := sub.Subscribe(ctx)
+	receive(t, ch, "a.example.org.")
+
+	if err := pub.Publish(ctx, testAnswer("b.example.org.")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, ch, "b.example.org.")
+}
+
+func TestStreamTransportNoReplay(t *testing.T) {
+	s := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pub := newTestStreamTransport(t, s.Addr(), 0)
+	defer pub.Close()
+	if err := pub.Publish(ctx, testAnswer("old.example.org.")); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := newTestStreamTransport(t, s.Addr(), 0)
+	defer sub.Close()
+	// Subscribe resolves the start ID past the old entry before returning.
+	ch := sub.Subscribe(ctx)
+	if err := pub.Publish(ctx, testAnswer("new.example.org.")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, ch, "new.example.org.")
+}
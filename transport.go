@@ -0,0 +1,35 @@
+package dcache
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	transportRedis  = "redis"
+	transportMemory = "memory"
+	transportStream = "stream"
+)
+
+var errTransportClosed = errors.New("transport is closed")
+
+// Transport delivers AnswerCache entries between the nodes of a cluster.
+type Transport interface {
+	// Publish sends ans to every subscriber of the cluster, including this node.
+	// It fails with an error wrapping errEncode when ans cannot be encoded.
+	Publish(ctx context.Context, ans *AnswerCache) error
+	// Subscribe returns a channel of entries published by the cluster.
+	// It returns once subscribed, so entries published after it returned are
+	// received, unless its first attempt failed and it keeps retrying in the background.
+	// The channel is closed when ctx is done or the transport is closed.
+	Subscribe(ctx context.Context) <-chan *AnswerCache
+	// Close releases the resources held by the transport.
+	Close() error
+}
+
+// BatchPublisher is implemented by transports that publish several entries
+// in one round trip. Entries that cannot be encoded are skipped, rather than
+// failing the batch.
+type BatchPublisher interface {
+	PublishBatch(ctx context.Context, ans []*AnswerCache) error
+}
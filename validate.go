@@ -0,0 +1,120 @@
+package dcache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxRecords caps the number of records in a received response.
+	maxRecords = 512
+	// maxMsgSize caps the wire size of a received response. It is four times
+	// the usual EDNS0 buffer size: a larger answer is resolved by every node
+	// instead of shared.
+	maxMsgSize = 16384
+)
+
+var errInvalid = errors.New("invalid entry")
+
+// validate checks that the response in ans answers the question it is cached
+// under, so that a buggy or hostile peer cannot plant records for other names.
+func validate(ans *AnswerCache) error {
+	m := ans.Response
+	if len(m.Question) != 1 {
+		return fmt.Errorf("%w: %d questions", errInvalid, len(m.Question))
+	}
+
+	q := m.Question[0]
+	qname := strings.ToLower(ans.Name)
+	if strings.ToLower(q.Name) != qname || q.Qtype != uint16(ans.Type) || q.Qclass != ans.class() {
+		return fmt.Errorf("%w: question %s does not match %s %s", errInvalid, q.String(), ans.Name, ans.Type)
+	}
+
+	if n := len(m.Answer) + len(m.Ns) + len(m.Extra); n > maxRecords {
+		return fmt.Errorf("%w: %d records", errInvalid, n)
+	}
+	if n := m.Len(); n > maxMsgSize {
+		return fmt.Errorf("%w: %d bytes", errInvalid, n)
+	}
+
+	// Answer records belong to the query chain: the question name and the
+	// targets of the CNAMEs in the answer, which may come in any order.
+	chain := map[string]bool{qname: true}
+	for grown := true; grown; {
+		grown = false
+		for _, rr := range m.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok {
+				owner, target := strings.ToLower(cname.Hdr.Name), strings.ToLower(cname.Target)
+				if chain[owner] && !chain[target] {
+					chain[target] = true
+					grown = true
+				}
+			}
+		}
+	}
+	for _, rr := range m.Answer {
+		owner := strings.ToLower(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.DNAME:
+			if !encloses(chain, owner) {
+				return fmt.Errorf("%w: %s is unrelated to %s", errInvalid, owner, qname)
+			}
+		case *dns.RRSIG:
+			if !chain[owner] && !(rr.TypeCovered == dns.TypeDNAME && encloses(chain, owner)) {
+				return fmt.Errorf("%w: %s is unrelated to %s", errInvalid, owner, qname)
+			}
+		default:
+			if !chain[owner] {
+				return fmt.Errorf("%w: %s is unrelated to %s", errInvalid, owner, qname)
+			}
+		}
+	}
+
+	// Authority records belong to a zone enclosing a name of the chain.
+	for _, rr := range m.Ns {
+		owner := strings.ToLower(rr.Header().Name)
+		if !encloses(chain, owner) {
+			return fmt.Errorf("%w: authority %s is out of bailiwick for %s", errInvalid, owner, qname)
+		}
+	}
+
+	// Additional records belong to the chain, or are the glue of a name
+	// server inside the zone it serves.
+	glue := map[string]bool{}
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range rrs {
+			if ns, ok := rr.(*dns.NS); ok && dns.IsSubDomain(ns.Hdr.Name, ns.Ns) {
+				glue[strings.ToLower(ns.Ns)] = true
+			}
+		}
+	}
+	for _, rr := range m.Extra {
+		owner := strings.ToLower(rr.Header().Name)
+		switch rr.(type) {
+		case *dns.OPT:
+			continue
+		case *dns.A, *dns.AAAA, *dns.RRSIG:
+			if glue[owner] {
+				continue
+			}
+		}
+		if !chain[owner] {
+			return fmt.Errorf("%w: additional %s is unrelated to %s", errInvalid, owner, qname)
+		}
+	}
+
+	return nil
+}
+
+// encloses reports whether owner is a name of chain or a zone enclosing one.
+func encloses(chain map[string]bool, owner string) bool {
+	for name := range chain {
+		if dns.IsSubDomain(owner, name) {
+			return true
+		}
+	}
+	return false
+}
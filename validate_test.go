@@ -0,0 +1,152 @@
+package dcache
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		name   string
+		typ    uint16
+		answer []dns.RR
+		ns     []dns.RR
+		extra  []dns.RR
+		valid  bool
+	}{
+		{
+			qname: "example.org.", qtype: dns.TypeA, name: "Example.org.", typ: dns.TypeA,
+			answer: []dns.RR{test.A("EXAMPLE.org.	3600	IN	A	127.0.0.1")},
+			ns:     []dns.RR{test.NS("org.	3600	IN	NS	a0.org.afilias-nst.info.")},
+			valid:  true,
+		},
+		{
+			qname: "www.example.org.", qtype: dns.TypeA, name: "www.example.org.", typ: dns.TypeA,
+			answer: []dns.RR{
+				test.CNAME("www.example.org.	3600	IN	CNAME	cdn.example.net."),
+				test.A("cdn.example.net.	3600	IN	A	127.0.0.1"),
+			},
+			valid: true,
+		},
+		{
+			qname: "www.example.org.", qtype: dns.TypeA, name: "www.example.org.", typ: dns.TypeA,
+			answer: []dns.RR{
+				test.DNAME("example.org.	3600	IN	DNAME	example.net."),
+				test.CNAME("www.example.org.	3600	IN	CNAME	www.example.net."),
+				test.A("www.example.net.	3600	IN	A	127.0.0.1"),
+			},
+			valid: true,
+		},
+		// The records of a chain may come in any order.
+		{
+			qname: "www.example.org.", qtype: dns.TypeA, name: "www.example.org.", typ: dns.TypeA,
+			answer: []dns.RR{
+				test.A("cdn.example.net.	3600	IN	A	127.0.0.1"),
+				test.CNAME("cdn.example.com.	3600	IN	CNAME	cdn.example.net."),
+				test.CNAME("www.example.org.	3600	IN	CNAME	cdn.example.com."),
+			},
+			valid: true,
+		},
+		// A delegation with the glue of its in-bailiwick name server.
+		{
+			qname: "www.example.org.", qtype: dns.TypeA, name: "www.example.org.", typ: dns.TypeA,
+			ns: []dns.RR{test.NS("example.org.	3600	IN	NS	ns1.example.org.")},
+			extra: []dns.RR{
+				test.A("ns1.example.org.	3600	IN	A	192.0.2.53"),
+				test.AAAA("ns1.example.org.	3600	IN	AAAA	2001:db8::53"),
+				&dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}},
+			},
+			valid: true,
+		},
+		// NXDOMAIN with the SOA of the enclosing zone.
+		{
+			qname: "missing.example.org.", qtype: dns.TypeA, name: "missing.example.org.", typ: dns.TypeA,
+			ns:    []dns.RR{test.SOA("example.org.	3600	IN	SOA	ns.example.org. admin.example.org. 1 3600 600 86400 300")},
+			valid: true,
+		},
+		// The question does not match the entry.
+		{
+			qname: "example.org.", qtype: dns.TypeA, name: "example.com.", typ: dns.TypeA,
+			answer: []dns.RR{test.A("example.org.	3600	IN	A	127.0.0.1")},
+		},
+		{
+			qname: "example.org.", qtype: dns.TypeAAAA, name: "example.org.", typ: dns.TypeA,
+			answer: []dns.RR{test.A("example.org.	3600	IN	A	127.0.0.1")},
+		},
+		// Records for names outside the query chain.
+		{
+			qname: "example.org.", qtype: dns.TypeA, name: "example.org.", typ: dns.TypeA,
+			answer: []dns.RR{
+				test.A("example.org.	3600	IN	A	127.0.0.1"),
+				test.A("bank.example.com.	3600	IN	A	127.0.0.1"),
+			},
+		},
+		{
+			qname: "www.example.org.", qtype: dns.TypeA, name: "www.example.org.", typ: dns.TypeA,
+			answer: []dns.RR{
+				test.CNAME("www.example.org.	3600	IN	CNAME	cdn.example.net."),
+				test.CNAME("bank.example.com.	3600	IN	CNAME	cdn.example.net."),
+			},
+		},
+		{
+			qname: "www.example.org.", qtype: dns.TypeA, name: "www.example.org.", typ: dns.TypeA,
+			answer: []dns.RR{test.A("www.example.org.	3600	IN	A	127.0.0.1")},
+			extra:  []dns.RR{test.A("bank.example.com.	3600	IN	A	203.0.113.66")},
+		},
+		// Glue of a name server outside the zone it serves.
+		{
+			qname: "www.example.org.", qtype: dns.TypeA, name: "www.example.org.", typ: dns.TypeA,
+			ns:    []dns.RR{test.NS("example.org.	3600	IN	NS	ns.attacker.example.")},
+			extra: []dns.RR{test.A("ns.attacker.example.	3600	IN	A	203.0.113.66")},
+		},
+		{
+			qname: "example.org.", qtype: dns.TypeA, name: "example.org.", typ: dns.TypeA,
+			answer: []dns.RR{test.A("example.org.	3600	IN	A	127.0.0.1")},
+			ns:     []dns.RR{test.NS("example.com.	3600	IN	NS	ns.attacker.example.")},
+		},
+	}
+
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		m.Answer = tc.answer
+		m.Ns = tc.ns
+		m.Extra = tc.extra
+
+		err := validate(&AnswerCache{Name: tc.name, Type: dns.Type(tc.typ), Response: m})
+		if tc.valid && err != nil {
+			t.Errorf("Test %d: expected valid, got %s", i, err)
+		}
+		if !tc.valid && !errors.Is(err, errInvalid) {
+			t.Errorf("Test %d: expected %s, got %v", i, errInvalid, err)
+		}
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	for i := 0; i <= maxRecords; i++ {
+		m.Answer = append(m.Answer, test.A("example.org.	3600	IN	A	127.0.0.1"))
+	}
+	if err := validate(&AnswerCache{Name: "example.org.", Type: dns.Type(dns.TypeA), Response: m}); !errors.Is(err, errInvalid) {
+		t.Errorf("Expected %s for %d records, got %v", errInvalid, len(m.Answer), err)
+	}
+
+	m = new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeTXT)
+	for i := 0; i < 70; i++ {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 3600},
+			Txt: []string{string(make([]byte, 255))},
+		})
+	}
+	if err := validate(&AnswerCache{Name: "example.org.", Type: dns.Type(dns.TypeTXT), Response: m}); !errors.Is(err, errInvalid) {
+		t.Errorf("Expected %s for %d bytes, got %v", errInvalid, m.Len(), err)
+	}
+}